@@ -4,10 +4,22 @@ package main
 // and the following URL before proceeding:
 // https://tinygo.org/docs/reference/lang-support/stdlib/
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"html"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	// For high performance you may want to consider replacing the
 	// default memory allocatory for tinygo as some has suggested that under
@@ -25,6 +37,23 @@ var (
 	// If the W3C traceparent and the istio x-request-id header are not present just send a generic id
 	defaultTraceID      = "00-0aa0000000aa00aa0000aa000a00000a-a0aa0a0000000000-00"
 	defaultProblemTitle = "service mesh returned an error"
+	// The response header used for the trace id when traceIDHeader is enabled without a name
+	defaultTraceIDHeader = "x-trace-id"
+	// The supported modes, see pluginConfiguration.mode
+	modeEnforce = "enforce"
+	modeShadow  = "shadow"
+	// The request header read when requestOverride is enabled without a header name
+	defaultRequestOverrideHeader = "x-problem-details"
+	// The request header holding the shared secret when requestOverride has a secret but no secretHeader
+	defaultRequestOverrideSecretHeader = "x-problem-details-secret"
+	// The values of the requestOverride header, off skips the transformation, on forces it and
+	// debug forces it with diagnostics
+	requestOverrideOff   = "off"
+	requestOverrideOn    = "on"
+	requestOverrideDebug = "debug"
+	// The supported errorID modes, random ids or ids derived from the trace id and the time of the error
+	errorIDModeRandom = "random"
+	errorIDModeTrace  = "trace"
 	// The following URIs will be sent for the type field in the JSON payload
 	defaultProblemTypeURIMap = map[string]string{
 		"400": "https://datatracker.ietf.org/html/rfc9110#section-15.5.1",
@@ -47,8 +76,136 @@ var (
 	// This will only be used if there is no mapping for the status code
 	default4xxProblemTypeURI = "https://datatracker.ietf.org/doc/html/rfc9110#name-client-error-4xx"
 	default5xxProblemTypeURI = "https://datatracker.ietf.org/doc/html/rfc9110#name-server-error-5xx"
+	// The IANA registered reason phrases, used as the default titles when problemTitles is configured
+	defaultProblemTitles = map[string]string{
+		"400": "Bad Request",
+		"401": "Unauthorized",
+		"402": "Payment Required",
+		"403": "Forbidden",
+		"404": "Not Found",
+		"405": "Method Not Allowed",
+		"406": "Not Acceptable",
+		"407": "Proxy Authentication Required",
+		"408": "Request Timeout",
+		"409": "Conflict",
+		"410": "Gone",
+		"411": "Length Required",
+		"412": "Precondition Failed",
+		"413": "Content Too Large",
+		"414": "URI Too Long",
+		"415": "Unsupported Media Type",
+		"416": "Range Not Satisfiable",
+		"417": "Expectation Failed",
+		"421": "Misdirected Request",
+		"422": "Unprocessable Content",
+		"423": "Locked",
+		"424": "Failed Dependency",
+		"425": "Too Early",
+		"426": "Upgrade Required",
+		"428": "Precondition Required",
+		"429": "Too Many Requests",
+		"431": "Request Header Fields Too Large",
+		"451": "Unavailable For Legal Reasons",
+		"500": "Internal Server Error",
+		"501": "Not Implemented",
+		"502": "Bad Gateway",
+		"503": "Service Unavailable",
+		"504": "Gateway Timeout",
+		"505": "HTTP Version Not Supported",
+		"506": "Variant Also Negotiates",
+		"507": "Insufficient Storage",
+		"508": "Loop Detected",
+		"510": "Not Extended",
+		"511": "Network Authentication Required",
+	}
+)
+
+// Envoy encodes the response flags as a bit-vector, these are the short names used in the access logs
+// in bit order so that templates and rules can refer to them the same way e.g. UO or UH
+var responseFlagNames = []string{
+	"LH", "UH", "UT", "LR", "UR", "UF", "UC", "UO", "NR", "DI", "FI", "RL", "UAEX", "RLSE", "DC", "URX",
+	"SI", "IH", "DPE", "UMSDR", "RFCF", "NFCF", "DT", "UPE", "NC", "OM",
+}
+
+var (
+	// The variables that can be used in the detailTemplate and in titles
+	problemTemplateVariables = []string{
+		"method", "scheme", "authority", "path", "status", "trace_id",
+		"upstream_cluster", "response_flags", "response_code_details", "body",
+	}
+	// The variables that can be used in the htmlTemplate
+	htmlTemplateVariables = []string{"title", "status", "detail", "instance", "trace_id", "type", "error_id", "timestamp"}
+)
+
+// These are variables so that tests can replace them with deterministic implementations.
+// The proxy implements the WASI clock and random functions, so nowFunc is the proxy's clock.
+var (
+	nowFunc    = time.Now
+	randomRead = rand.Read
+	// The emulator never fails to replace the response so the tests replace these to check commitResponse
+	replaceResponseBody    = proxywasm.ReplaceHttpResponseBody
+	replaceResponseHeaders = proxywasm.ReplaceHttpResponseHeaders
+)
+
+// defaultHTMLTemplate is the error page sent to browsers when htmlErrorPages is enabled and no
+// htmlTemplate is supplied in the plugin configuration. It is embedded into the wasm binary at build time.
+//
+//go:embed error-page.html
+var defaultHTMLTemplate string
+
+// The counters exposed through Envoy's stats, see pluginMetrics
+const (
+	metricPrefix        = "problem_details"
+	metricErrorsSeen    = "errors_seen"
+	metricRewritten     = "rewritten"
+	metricPassedThrough = "passed_through"
+	metricSkipped       = "skipped"
+	metricFailures      = "failures"
+	// Responses that would have been rewritten in shadow mode
+	metricShadowRewritten = "shadow_rewritten"
+
+	metricOriginalBodyBytes   = "original_body_bytes"
+	metricOutputBodyBytes     = "output_body_bytes"
+	metricTransformDurationUs = "transform_duration_us"
+
+	failureStageReadHeaders = "read_headers"
+	failureStageReadBody    = "read_body"
+	failureStageRender      = "render"
+	failureStageCommit      = "commit"
+
+	// The filter state keys, Envoy stores them with a wasm. prefix
+	filterStateProblemType    = "problem_details.type"
+	filterStateRule           = "problem_details.rule"
+	filterStateOriginalStatus = "problem_details.original_status"
+	filterStateRewritten      = "problem_details.rewritten"
+
+	// The rule name used when the request matched the top level targetURLPrefixes
+	defaultRuleName = "default"
+	// The header matcher conditions, see headerMatcher
+	headerMatchPresent = "present"
+	headerMatchExact   = "exact"
+	headerMatchPrefix  = "prefix"
+	headerMatchRegex   = "regex"
+
+	// The rule name used when the transformation was forced by the requestOverride header
+	requestOverrideRuleName = "request_override"
+	// The rule name used when the route metadata enabled the transformation
+	routeRuleName = "route"
+	// The rule tag of the metrics for errors that no rule matched
+	noRuleName = "none"
+
+	// The route settings are the fields of xds.route_metadata.filter_metadata.<namespace>,
+	// or a JSON string in its <key> field, see readRouteMetadata
+	defaultRouteMetadataNamespace = "problem_details"
+	defaultRouteMetadataKey       = "config"
+	// The number of distinct route configurations that are cached, the routes are
+	// part of the proxy configuration so this is only reached by a misconfiguration
+	maxRouteConfigs = 1000
 )
 
+// The rule names used by the plugin itself, a configured rule can't use them
+var reservedRuleNames = []string{defaultRuleName, routeRuleName, requestOverrideRuleName, noRuleName}
+
 // -------------------- NOTES--------------------
 // This plugin only works with http 2.0 because Istio requires http 2.0 and will send an
 // 426 status code "upgrade required"
@@ -79,34 +236,225 @@ type pluginContext struct {
 	// so that we don't need to reimplement all the methods.
 	types.DefaultPluginContext
 	configuration pluginConfiguration
+	metrics       *pluginMetrics
+	logger        *logger
+	// The parsed route settings shared by every http context, see routeConfigKey
+	routeConfigs map[routeConfigKey]*routeConfig
+}
+
+// routeConfigKey identifies the route settings parsed on top of a configuration
+type routeConfigKey struct {
+	base     *pluginConfiguration
+	metadata string
+}
+
+// routeConfig is the result of applying the route metadata, the app teams own the route metadata
+// so an invalid configuration is logged and ignored rather than failing their requests
+type routeConfig struct {
+	// nil when the route only sets enabled or its settings are invalid
+	config *pluginConfiguration
+	// when set the route turns the transformation on or off
+	enabled *bool
 }
 
 // pluginConfiguration is a type to represent an example configuration for this wasm plugin.
 type pluginConfiguration struct {
 	// Only modify responses for specific endpoint prefixes
 	targetURLPrefixes []string
-	// Only modify response status code >= startStatusCode && <= endStatusCode
-	// The plugin will default to startStatusCode = 400 and endStatusCode = 599
-	startStatusCode   int
-	endStatusCode     int
+	// The named rules are tried in order before the top level targetURLPrefixes, which form the default rule
+	rules []rewriteRule
+	// Only modify responses with these status codes, either the statusCodes set e.g. "401,403,5xx,!503"
+	// or startStatusCode to endStatusCode, which default to 400 and 599
+	statusCodes statusSet
+	// The problem type URIs keyed by status code, the configured problemTypeURIMap is merged
+	// into the defaults (or the URIs generated from problemTypeBaseURI)
 	problemTypeURIMap map[string]string
 	// Defaults to "service mesh returned an error"
 	problemTitle string
+	// Titles keyed by status code or problem type URI, when configured the IANA reason phrases are
+	// used for any status code that is not listed and problemTitle only applies to unknown status codes
+	problemTitles map[string]string
+	// Titles keyed by language tag (e.g. "de" or "pt-br") and then by status code or problem type URI
+	localizedProblemTitles map[string]map[string]string
+	// When true browsers (clients that prefer text/html) get an HTML error page instead of problem+json
+	htmlErrorPages bool
+	// The HTML error page template, defaults to the embedded error-page.html
+	htmlTemplate string
+	// When set the detail is rendered from this template instead of being the original response body
+	detailTemplate string
+	// templates holds every title, the detailTemplate and the htmlTemplate compiled at start up keyed by their source
+	templates map[string]*textTemplate
+	// Rules to present a different status code to the client, the first matching rule is applied
+	statusRemaps []statusRemap
+	// Status codes that get a Retry-After header and the rate limit extension members, empty when disabled
+	retryAfterStatusCodes []int
+	// The Retry-After value used when the upstream did not say when to retry
+	defaultRetryAfterSeconds int
+	// Lets callers skip or force the transformation with a request header
+	requestOverride requestOverride
+	// Which upstream headers are kept on rewritten error responses
+	responseHeaderPolicy responseHeaderPolicy
+	// When set rewritten errors carry the trace id in this response header, defaults to x-trace-id
+	traceIDHeader string
+	// Add the trace id header to every response, not just rewritten errors
+	traceIDHeaderAllResponses bool
+	// Add a Link header pointing to the problem type documentation on rewritten errors
+	problemTypeLinkHeader bool
+	// How the error_id extension member is generated, "random" or "trace", empty when disabled
+	errorIDMode string
+	// Add the timestamp extension member
+	includeTimestamp bool
+	// In shadow mode the rules are evaluated and the problem documents are built and logged
+	// but the responses are left untouched, defaults to enforce
+	mode string
+	// Per virtual host settings, each one is the top level configuration with the virtual host block overlaid
+	virtualHosts *virtualHosts
+	// Where to find per route settings in the route metadata, empty when disabled
+	routeMetadataNamespace string
+	routeMetadataKey       string
+	// The configuration document this configuration was parsed from, the route settings are overlaid on it
+	document gjson.Result
+	// Records below this level are not sent to the proxy, defaults to info
+	logLevel logLevel
+	// Only log 1 in every N records of an event, keyed by event name e.g. {"response_rewritten": 100}
+	logSampling map[string]uint64
+}
+
+// requestOverride lets internal tools and contract tests get the raw upstream error (off) or force
+// the transformation (on or debug) for a single request
+type requestOverride struct {
+	// The request header with the off, on or debug value, empty when disabled
+	header string
+	// When secret is set the override is only honoured if secretHeader carries the same value
+	secretHeader string
+	secret       string
+	// When true the debug value adds the debug extension member, a secret is required
+	allowDebug bool
+}
+
+// responseHeaderPolicy controls the headers of rewritten error responses so that they don't leak internals or get cached.
+// Header names are matched case insensitively and a trailing * matches any header with that prefix e.g. x-internal-*
+type responseHeaderPolicy struct {
+	// When set only these headers are kept, pseudo headers, content-type, content-length and retry-after are always kept
+	allow []string
+	// These headers are always removed
+	deny []string
+	// Replace any cache-control header with no-store
+	cacheControlNoStore bool
+	// Keep the access-control-* headers regardless of allow and deny so browsers can still read the error
+	preserveCORS bool
+}
+
+// virtualHosts holds the configuration of each virtual host so that one plugin can serve many tenants
+type virtualHosts struct {
+	// keyed by host without the port
+	exact map[string]*pluginConfiguration
+	// sorted so that the longest suffix is first
+	wildcards []wildcardVirtualHost
+	// the * block, used when no other host matches
+	fallback *pluginConfiguration
+}
+
+// wildcardVirtualHost matches any host ending in suffix e.g. .example.com for *.example.com
+type wildcardVirtualHost struct {
+	suffix string
+	config *pluginConfiguration
+}
+
+// find returns the configuration for the :authority, nil when there is none and the top level configuration applies
+func (vhosts *virtualHosts) find(authority string) *pluginConfiguration {
+	if vhosts == nil {
+		return nil
+	}
+	host := strings.ToLower(StripPort(authority))
+	if config, ok := vhosts.exact[host]; ok {
+		return config
+	}
+	for _, wildcard := range vhosts.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.config
+		}
+	}
+	return vhosts.fallback
+}
+
+// StripPort removes the port from an :authority e.g. example.com:8080 or [::1]:8080
+func StripPort(authority string) string {
+	i := strings.LastIndexByte(authority, ':')
+	if i < 0 || strings.HasSuffix(authority, "]") {
+		return authority
+	}
+	if _, err := strconv.Atoi(authority[i+1:]); err != nil {
+		return authority
+	}
+	return authority[:i]
+}
+
+// rewriteRule selects the requests whose error responses are modified
+type rewriteRule struct {
+	name              string
+	targetURLPrefixes []string
+	// The percentage of matching requests that are modified, between 0 and 100 and defaults to 100
+	rolloutPercentage float64
+	// The request header hashed for the rollout decision, defaults to the trace id
+	rolloutHashHeader string
+	// When set the request method must be one of these, otherwise any method but CONNECT matches
+	methods []string
+	// Every matcher must match a request header
+	requestHeaders []headerMatcher
+	// When set the upstream content-type must be in one of these families e.g. text/plain or text/*
+	contentTypes []string
+	// Every matcher must match a response header
+	responseHeaders []headerMatcher
+}
+
+// ruleCandidate is a rule that matched the request, the rollout is decided up front because
+// the request headers can't be read once the response has started
+type ruleCandidate struct {
+	rule      *rewriteRule
+	inRollout bool
+}
+
+// headerMatcher matches a header by name and one of the conditions e.g. {"name": "x-api-version", "prefix": "2."}
+type headerMatcher struct {
+	name string
+	// one of headerMatchPresent, headerMatchExact, headerMatchPrefix or headerMatchRegex
+	match string
+	// the value for exact and prefix matches, "true" or "false" for present
+	value string
+	regex *regexp.Regexp
+}
+
+// statusRemap changes the status code of an error response when all of its conditions match
+type statusRemap struct {
+	// Only used to identify the rule in the logs
+	name string
+	from int
+	to   int
+	// When set at least one of the Envoy response flags (e.g. UO) must be present
+	responseFlags []string
+	// When set the request URL must match one of the prefixes
+	targetURLPrefixes []string
 }
 
 // Override types.DefaultPluginContext.
 func (ctx *pluginContext) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
+	// Until the configuration has been parsed the default log level is used
+	ctx.logger = newLogger(logLevelInfo, nil)
 	data, err := proxywasm.GetPluginConfiguration()
 	if err != nil && err != types.ErrorStatusNotFound {
-		proxywasm.LogCriticalf("error reading plugin configuration: %v", err)
+		ctx.logger.log(logLevelCritical, logRecord{Event: "plugin_config_read_failed", Message: "error reading plugin configuration", Error: err.Error()})
 		return types.OnPluginStartStatusFailed
 	}
 	config, err := parsePluginConfiguration(data)
 	if err != nil {
-		proxywasm.LogCriticalf("error parsing plugin configuration: %v", err)
+		ctx.logger.log(logLevelCritical, logRecord{Event: "plugin_config_invalid", Message: "error parsing plugin configuration", Error: err.Error()})
 		return types.OnPluginStartStatusFailed
 	}
 	ctx.configuration = config
+	ctx.metrics = newPluginMetrics()
+	ctx.routeConfigs = make(map[routeConfigKey]*routeConfig)
+	ctx.logger = newLogger(config.logLevel, config.logSampling)
 	return types.OnPluginStartStatusOK
 }
 
@@ -115,31 +463,110 @@ func (ctx *pluginContext) OnPluginStart(pluginConfigurationSize int) types.OnPlu
 // You can also try https://github.com/mailru/easyjson, which supports decoding to a struct.
 func parsePluginConfiguration(data []byte) (pluginConfiguration, error) {
 	if len(data) == 0 {
-		return pluginConfiguration{}, nil
+		// The zero value of logLevel is trace so the default level has to be set
+		return pluginConfiguration{logLevel: logLevelInfo}, nil
 	}
 
-	config := &pluginConfiguration{}
 	if !gjson.ValidBytes(data) {
 		return pluginConfiguration{}, fmt.Errorf("the plugin configuration is not a valid json: %q", string(data))
 	}
 
+	// Every problem is collected so that they can all be fixed at once, the type checks run
+	// first so that a value of the wrong type isn't reported a second time by parseConfiguration
+	errs := newConfigErrors("$")
 	jsonData := gjson.ParseBytes(data)
-	targetURLPrefixes := jsonData.Get("targetURLPrefixes").Array()
-	for _, prefix := range targetURLPrefixes {
-		config.targetURLPrefixes = append(config.targetURLPrefixes, prefix.Str)
+	validateConfigurationTypes("$", jsonData, pluginConfigurationSchema, errs)
+	config := parseConfiguration(jsonData, errs)
+	if routeMetadata := jsonData.Get("routeMetadata"); routeMetadata.Exists() {
+		config.routeMetadataNamespace = routeMetadata.Get("namespace").String()
+		if config.routeMetadataNamespace == "" {
+			config.routeMetadataNamespace = defaultRouteMetadataNamespace
+		}
+		config.routeMetadataKey = routeMetadata.Get("key").String()
+		if config.routeMetadataKey == "" {
+			config.routeMetadataKey = defaultRouteMetadataKey
+		}
+	}
+	// The virtual hosts are built on top of the top level settings so any problem there would be reported again
+	if len(errs.messages) == 0 {
+		config.virtualHosts = parseVirtualHosts(jsonData, errs)
 	}
 
-	if len(config.targetURLPrefixes) < 1 {
-		return pluginConfiguration{}, fmt.Errorf("the plugin configuration is missing targetURLPrefixes: %q", string(data))
+	if len(errs.messages) > 0 {
+		return pluginConfiguration{}, errs
 	}
+	return config, nil
+}
 
-	var problemTypeURIMap map[string]string
-	tempProblemTypeURIMap := jsonData.Get("problemTypeURIMap").Map()
-	if len(tempProblemTypeURIMap) == 0 {
-		config.problemTypeURIMap = defaultProblemTypeURIMap
+// parseConfiguration parses the settings of a configuration document, the problems are added to errs
+func parseConfiguration(jsonData gjson.Result, errs *configErrors) pluginConfiguration {
+	config := &pluginConfiguration{document: jsonData}
+	ruleNames := make(map[string]bool)
+	for i, ruleData := range jsonData.Get("rules").Array() {
+		path := fmt.Sprintf("$.rules[%d]", i)
+		name := ruleData.Get("name").String()
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		// The rule name tags the metrics and filter state so it has to identify a single rule
+		if containsString(reservedRuleNames, name) {
+			errs.add(path+".name", "%q is reserved", name)
+		} else if ruleNames[name] {
+			errs.add(path+".name", "duplicate rule name %q", name)
+		}
+		ruleNames[name] = true
+		rule := parseRewriteRule(name, path, ruleData, errs)
+		if len(rule.targetURLPrefixes) < 1 {
+			errs.add(path+".targetURLPrefixes", "is required")
+		}
+		config.rules = append(config.rules, rule)
+	}
 
+	defaultRule := parseRewriteRule(defaultRuleName, "$", jsonData, errs)
+	config.targetURLPrefixes = defaultRule.targetURLPrefixes
+	if len(config.targetURLPrefixes) > 0 {
+		config.rules = append(config.rules, defaultRule)
 	} else {
+		for _, key := range []string{"rollout", "methods", "requestHeaders", "contentTypes", "responseHeaders"} {
+			if jsonData.Get(key).Exists() {
+				errs.add("$.targetURLPrefixes", "is required for the %s of the default rule", key)
+			}
+		}
+	}
+
+	if len(config.rules) < 1 {
+		errs.add("$.targetURLPrefixes", "is required unless rules are configured")
+	}
+
+	config.problemTypeURIMap = defaultProblemTypeURIMap
+	if baseURI := jsonData.Get("problemTypeBaseURI"); baseURI.Exists() {
+		if err := validateProblemTypeBaseURI(baseURI.String()); err != nil {
+			errs.add("$.problemTypeBaseURI", "%v", err)
+		}
+		config.problemTypeURIMap = make(map[string]string, 200)
+		for statusCode := 400; statusCode <= 599; statusCode++ {
+			key := strconv.Itoa(statusCode)
+			config.problemTypeURIMap[key] = ExpandProblemTypeBaseURI(baseURI.String(), key)
+		}
+	}
+	// Individual status codes are overridden and a null removes the mapping so that the 4xx or 5xx default is used
+	if tempProblemTypeURIMap := jsonData.Get("problemTypeURIMap").Map(); len(tempProblemTypeURIMap) > 0 {
+		problemTypeURIMap := make(map[string]string, len(config.problemTypeURIMap)+len(tempProblemTypeURIMap))
+		for k, v := range config.problemTypeURIMap {
+			problemTypeURIMap[k] = v
+		}
 		for k, v := range tempProblemTypeURIMap {
+			path := fmt.Sprintf("$.problemTypeURIMap[%q]", k)
+			if !isErrorStatusCode(k) {
+				errs.add(path, "%q is not a status code between 400 and 599", k)
+			}
+			if v.Type == gjson.Null {
+				delete(problemTypeURIMap, k)
+				continue
+			}
+			if !IsURIReference(v.String()) {
+				errs.add(path, "%q is not a valid URI reference", v.String())
+			}
 			problemTypeURIMap[k] = v.String()
 		}
 		config.problemTypeURIMap = problemTypeURIMap
@@ -151,250 +578,2388 @@ func parsePluginConfiguration(data []byte) (pluginConfiguration, error) {
 	}
 	config.problemTitle = problemTitle
 
-	// If non-sensical input is given for the start/end status code use our own defaults
-	startStatusCode := jsonData.Get("startStatusCode").Int()
-	if startStatusCode < 400 {
-		startStatusCode = 400
-	}
-	config.startStatusCode = int(startStatusCode)
-	endStatusCode := jsonData.Get("endStatusCode").Int()
-	if endStatusCode < 400 || endStatusCode > 599 {
-		endStatusCode = 599
+	if problemTitles := jsonData.Get("problemTitles"); problemTitles.Exists() {
+		config.problemTitles = make(map[string]string, len(defaultProblemTitles))
+		for k, v := range defaultProblemTitles {
+			config.problemTitles[k] = v
+		}
+		for k, v := range problemTitles.Map() {
+			if !isProblemTitleKey(k) {
+				errs.add(fmt.Sprintf("$.problemTitles[%q]", k), "%q is not a status code between 400 and 599 or a problem type URI", k)
+			}
+			config.problemTitles[k] = v.String()
+		}
 	}
-	config.endStatusCode = int(endStatusCode)
-
-	return *config, nil
-}
 
-// Override types.DefaultPluginContext.
-func (ctx *pluginContext) NewHttpContext(contextID uint32) types.HttpContext {
-	return &customErrorsContext{
-		targetURLPrefixes: ctx.configuration.targetURLPrefixes,
-		startStatusCode:   ctx.configuration.startStatusCode,
-		endStatusCode:     ctx.configuration.endStatusCode,
-		problemTypeURIMap: ctx.configuration.problemTypeURIMap,
-		problemTitle:      ctx.configuration.problemTitle,
-		modifyResponse:    false,
+	localizedProblemTitles := jsonData.Get("localizedProblemTitles").Map()
+	if len(localizedProblemTitles) > 0 {
+		config.localizedProblemTitles = make(map[string]map[string]string, len(localizedProblemTitles))
+		for language, titles := range localizedProblemTitles {
+			localized := make(map[string]string)
+			for k, v := range titles.Map() {
+				if !isProblemTitleKey(k) {
+					errs.add(fmt.Sprintf("$.localizedProblemTitles[%q][%q]", language, k), "%q is not a status code between 400 and 599 or a problem type URI", k)
+				}
+				localized[k] = v.String()
+			}
+			config.localizedProblemTitles[strings.ToLower(language)] = localized
+		}
 	}
-}
-
-// customErrorResponse represents the information that will be included in the problem JSON response
-type customErrorResponse struct {
-	// type" (string) - A URI reference [RFC3986] that identifies the problem type.
-	Type string `json:"type"`
-	// "title" (string) - A short, human-readable summary of the problem type
-	// in our case this will be hard-coded to a single value for all types of errors
-	// we can change this in future if Walmart wants unique values to be used
-	Title string `json:"title"`
-	// The HTTP status code
-	Status int `json:"status"`
-	// This is just the request path
-	Instance string `json:"instance"`
-	// The trace id for the purpose of error correlation, usually the value of the W3C Traceparent header or the istio x-request-id header
-	// if neither are present in the request/response then use a static value
-	TraceID string `json:"trace_id"`
-	// The original error text returned by Istio
-	Detail string `json:"detail"`
-}
 
-// customErrorsContext implements types.HttpContext interface of proxy-wasm-go SDK.
-type customErrorsContext struct {
-	// Embed the default root http context here,
-	// so that we don't need to reimplement all the methods.
-	types.DefaultHttpContext
-
-	// totalResponseBodySize
-	totalResponseBodySize int
+	startStatusCode := 400
+	if value := jsonData.Get("startStatusCode"); value.Exists() {
+		startStatusCode = int(value.Int())
+		if startStatusCode < 400 || startStatusCode > 599 {
+			errs.add("$.startStatusCode", "must be between 400 and 599: %d", startStatusCode)
+		}
+	}
+	endStatusCode := 599
+	if value := jsonData.Get("endStatusCode"); value.Exists() {
+		endStatusCode = int(value.Int())
+		if endStatusCode < 400 || endStatusCode > 599 {
+			errs.add("$.endStatusCode", "must be between 400 and 599: %d", endStatusCode)
+		}
+	}
+	if startStatusCode > endStatusCode {
+		errs.add("$.endStatusCode", "the range %d-%d is empty", startStatusCode, endStatusCode)
+	}
+	config.statusCodes.addRange(startStatusCode, endStatusCode)
+	if value := jsonData.Get("statusCodes"); value.Exists() {
+		if jsonData.Get("startStatusCode").Exists() || jsonData.Get("endStatusCode").Exists() {
+			errs.add("$.statusCodes", "can't be combined with startStatusCode and endStatusCode")
+		}
+		statusCodes, err := ParseStatusSet(value.String())
+		if err != nil {
+			errs.add("$.statusCodes", "%v", err)
+		}
+		config.statusCodes = statusCodes
+	}
 
-	// the requestURL - used to determine if we should modify the response or not
-	requestURL string
-	// the request path e.g. if the ur is `https://foo.com/bar` the path would be `/bar`
-	requestPath string
-	traceID     string
-	statusCode  int
+	config.htmlErrorPages = jsonData.Get("htmlErrorPages").Bool()
+	htmlTemplate := jsonData.Get("htmlTemplate").String()
+	if htmlTemplate == "" {
+		htmlTemplate = defaultHTMLTemplate
+	}
+	config.htmlTemplate = htmlTemplate
 
-	// modifyResponse when true will result in the response being sent back in rfc9457 format
-	modifyResponse bool
+	config.detailTemplate = jsonData.Get("detailTemplate").String()
 
-	// Only modify responses for specific endpoint prefixes
-	targetURLPrefixes []string
-	// Only modify response status code >= startStatusCode && <= endStatusCode
-	// The plugin will default to startStatusCode = 400 and endStatusCode = 599
-	startStatusCode   int
-	endStatusCode     int
-	problemTypeURIMap map[string]string
-	// Defaults to "service mesh returned an error"
-	problemTitle string
-}
+	headerPolicy := jsonData.Get("responseHeaderPolicy")
+	for _, name := range headerPolicy.Get("allow").Array() {
+		config.responseHeaderPolicy.allow = append(config.responseHeaderPolicy.allow, strings.ToLower(name.String()))
+	}
+	for _, name := range headerPolicy.Get("deny").Array() {
+		config.responseHeaderPolicy.deny = append(config.responseHeaderPolicy.deny, strings.ToLower(name.String()))
+	}
+	config.responseHeaderPolicy.cacheControlNoStore = headerPolicy.Get("cacheControlNoStore").Bool()
+	config.responseHeaderPolicy.preserveCORS = headerPolicy.Get("preserveCORS").Bool()
 
-// MatchesTargetURLPrefixes returns true if the request URL matches one of the targetURLPrefixes
-func MatchesTargetURLPrefixes(requestURL string, targetURLPrefixes []string) bool {
-	for _, prefix := range targetURLPrefixes {
-		if strings.Contains(requestURL, prefix) {
-			return true
+	if traceIDHeader := jsonData.Get("traceIDHeader"); traceIDHeader.Exists() {
+		config.traceIDHeader = strings.ToLower(traceIDHeader.Get("name").String())
+		if config.traceIDHeader == "" {
+			config.traceIDHeader = defaultTraceIDHeader
+		} else if !IsHeaderName(config.traceIDHeader) {
+			errs.add("$.traceIDHeader.name", "must be a header name: %q", config.traceIDHeader)
 		}
+		config.traceIDHeaderAllResponses = traceIDHeader.Get("allResponses").Bool()
 	}
-	return false
-}
+	config.problemTypeLinkHeader = jsonData.Get("problemTypeLinkHeader").Bool()
 
-// GetProblemTypeURI returns the problem type URI for a specific status code
-func GetProblemTypeURI(statusCode string, problemTypeURIMap map[string]string) string {
-	problemTypeURI := ""
-	if val, ok := problemTypeURIMap[statusCode]; ok {
-		problemTypeURI = val
+	if override := jsonData.Get("requestOverride"); override.Exists() {
+		config.requestOverride.header = strings.ToLower(override.Get("header").String())
+		if config.requestOverride.header == "" {
+			config.requestOverride.header = defaultRequestOverrideHeader
+		} else if !IsHeaderName(config.requestOverride.header) {
+			errs.add("$.requestOverride.header", "must be a header name: %q", config.requestOverride.header)
+		}
+		config.requestOverride.secret = override.Get("secret").String()
+		if config.requestOverride.secret != "" {
+			config.requestOverride.secretHeader = strings.ToLower(override.Get("secretHeader").String())
+			if config.requestOverride.secretHeader == "" {
+				config.requestOverride.secretHeader = defaultRequestOverrideSecretHeader
+			} else if !IsHeaderName(config.requestOverride.secretHeader) {
+				errs.add("$.requestOverride.secretHeader", "must be a header name: %q", config.requestOverride.secretHeader)
+			}
+		}
+		config.requestOverride.allowDebug = override.Get("allowDebug").Bool()
+		if config.requestOverride.allowDebug && config.requestOverride.secret == "" {
+			errs.add("$.requestOverride.allowDebug", "requires a secret")
+		}
 	}
 
-	if problemTypeURI == "" && strings.HasPrefix(statusCode, "4") {
-		problemTypeURI = default4xxProblemTypeURI
-	} else if problemTypeURI == "" && strings.HasPrefix(statusCode, "5") {
-		problemTypeURI = default5xxProblemTypeURI
+	config.mode = jsonData.Get("mode").String()
+	if config.mode == "" {
+		config.mode = modeEnforce
+	}
+	if config.mode != modeEnforce && config.mode != modeShadow {
+		errs.add("$.mode", "must be %q or %q: %q", modeEnforce, modeShadow, config.mode)
 	}
-	return problemTypeURI
-}
-
-// Override types.DefaultHttpContext.
-func (ctx *customErrorsContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
-
-	var requestURL string
-	var traceID string
-
-	proxywasm.LogInfof("BEGIN OnHttpRequestHeaders")
 
-	scheme, err := proxywasm.GetHttpRequestHeader(":scheme")
-	if err != nil {
-		proxywasm.LogErrorf("failed to get request header scheme. Error: %v", err)
+	config.logLevel = logLevelInfo
+	if logLevelName := jsonData.Get("logLevel").String(); logLevelName != "" {
+		level, err := parseLogLevel(logLevelName)
+		if err != nil {
+			errs.add("$.logLevel", "%v", err)
+		}
+		config.logLevel = level
+	}
+	for event, rate := range jsonData.Get("logSampling").Map() {
+		if rate.Int() < 1 {
+			errs.add(fmt.Sprintf("$.logSampling[%q]", event), "must be at least 1: %s", rate.Raw)
+		}
+		if config.logSampling == nil {
+			config.logSampling = make(map[string]uint64)
+		}
+		config.logSampling[event] = uint64(rate.Int())
 	}
 
-	authority, err := proxywasm.GetHttpRequestHeader(":authority")
-	if err != nil {
-		proxywasm.LogErrorf("failed to get request header authority. Error: %v", err)
+	config.errorIDMode = jsonData.Get("errorID").String()
+	if config.errorIDMode != "" && config.errorIDMode != errorIDModeRandom && config.errorIDMode != errorIDModeTrace {
+		errs.add("$.errorID", "must be %q or %q: %q", errorIDModeRandom, errorIDModeTrace, config.errorIDMode)
 	}
+	config.includeTimestamp = jsonData.Get("timestamp").Bool()
 
-	path, err := proxywasm.GetHttpRequestHeader(":path")
-	if err != nil {
-		proxywasm.LogErrorf("failed to get request header path. Error: %v", err)
+	if retryAfter := jsonData.Get("retryAfter"); retryAfter.Exists() {
+		config.retryAfterStatusCodes = []int{429, 503}
+		if statusCodes := retryAfter.Get("statusCodes"); statusCodes.Exists() {
+			config.retryAfterStatusCodes = nil
+			for i, statusCode := range statusCodes.Array() {
+				if statusCode.Int() < 400 || statusCode.Int() > 599 {
+					errs.add(fmt.Sprintf("$.retryAfter.statusCodes[%d]", i), "must be between 400 and 599: %s", statusCode.Raw)
+				}
+				config.retryAfterStatusCodes = append(config.retryAfterStatusCodes, int(statusCode.Int()))
+			}
+		}
+		config.defaultRetryAfterSeconds = int(retryAfter.Get("seconds").Int())
+		if config.defaultRetryAfterSeconds < 0 {
+			errs.add("$.retryAfter.seconds", "must not be negative: %d", config.defaultRetryAfterSeconds)
+		}
 	}
 
-	// If the W3C traceparent header is not present use the istio x-request-id instead
-	traceID, err = proxywasm.GetHttpRequestHeader("traceparent")
-	if err != nil || traceID == "" {
-		proxywasm.LogInfof("failed to get request header traceparent, will use x-request-id instead. Error: %v", err)
-		traceID, err = proxywasm.GetHttpRequestHeader("x-request-id")
-		// If that is also nil then use the default trace id
-		if err != nil || traceID == "" {
-			proxywasm.LogInfof("failed to get request header x-request-id, will use the default trace id. Error: %v", err)
-			traceID = defaultTraceID
+	for i, rule := range jsonData.Get("statusRemaps").Array() {
+		path := fmt.Sprintf("$.statusRemaps[%d]", i)
+		remap := statusRemap{
+			name: rule.Get("name").String(),
+			from: int(rule.Get("from").Int()),
+			to:   int(rule.Get("to").Int()),
+		}
+		if remap.name == "" {
+			remap.name = strconv.Itoa(i)
+		}
+		if remap.from < 400 || remap.from > 599 {
+			errs.add(path+".from", "must be between 400 and 599: %d", remap.from)
 		}
+		if remap.to < 400 || remap.to > 599 {
+			errs.add(path+".to", "must be between 400 and 599: %d", remap.to)
+		}
+		for j, flag := range rule.Get("responseFlags").Array() {
+			if !containsString(responseFlagNames, flag.String()) {
+				errs.add(fmt.Sprintf("%s.responseFlags[%d]", path, j), "unknown response flag %q", flag.String())
+			}
+			remap.responseFlags = append(remap.responseFlags, flag.String())
+		}
+		for j, prefix := range rule.Get("targetURLPrefixes").Array() {
+			if prefix.String() == "" {
+				errs.add(fmt.Sprintf("%s.targetURLPrefixes[%d]", path, j), "must not be empty, it would match every request")
+			}
+			remap.targetURLPrefixes = append(remap.targetURLPrefixes, prefix.String())
+		}
+		config.statusRemaps = append(config.statusRemaps, remap)
 	}
 
-	requestURL = fmt.Sprintf("%s://%s%s", scheme, authority, path)
+	// Compile every template up front so that typos fail the plugin start rather than individual requests
+	config.templates = make(map[string]*textTemplate)
+	compile := func(path string, source string, allowedVars []string) {
+		compiled, err := parseTextTemplate(source, allowedVars)
+		if err != nil {
+			errs.add(path, "%v", err)
+			return
+		}
+		config.templates[source] = compiled
+	}
+	compile("$.problemTitle", config.problemTitle, problemTemplateVariables)
+	compile("$.detailTemplate", config.detailTemplate, problemTemplateVariables)
+	for key, title := range config.problemTitles {
+		compile(fmt.Sprintf("$.problemTitles[%q]", key), title, problemTemplateVariables)
+	}
+	for language, titles := range config.localizedProblemTitles {
+		for key, title := range titles {
+			compile(fmt.Sprintf("$.localizedProblemTitles[%q][%q]", language, key), title, problemTemplateVariables)
+		}
+	}
+	compile("$.htmlTemplate", config.htmlTemplate, htmlTemplateVariables)
 
-	ctx.requestURL = requestURL
-	ctx.requestPath = path
-	ctx.traceID = traceID
+	return *config
+}
 
-	proxywasm.LogInfof("request url: %s, trace id: %s", requestURL, traceID)
-	proxywasm.LogInfof("END OnHttpRequestHeaders")
+// parseVirtualHosts parses the virtualHosts blocks, each block is overlaid on the top level settings
+// and parsed as a configuration of its own
+func parseVirtualHosts(jsonData gjson.Result, errs *configErrors) *virtualHosts {
+	hosts := jsonData.Get("virtualHosts")
+	if !hosts.Exists() {
+		return nil
+	}
+	vhosts := &virtualHosts{exact: make(map[string]*pluginConfiguration)}
+	hosts.ForEach(func(key, block gjson.Result) bool {
+		pattern := strings.ToLower(key.String())
+		path := fmt.Sprintf("$.virtualHosts[%q]", key.String())
+		wildcard := strings.HasPrefix(pattern, "*.")
+		if pattern == "" || (pattern != "*" && strings.Contains(strings.TrimPrefix(pattern, "*."), "*")) {
+			errs.add(path, "must be a host, a wildcard host e.g. *.example.com or * for the default block")
+			return true
+		}
+		// The port is removed from the :authority before the hosts are matched so a block with one would never be used
+		if StripPort(pattern) != pattern {
+			errs.add(path, "must not have a port, the port of the :authority is ignored")
+			return true
+		}
+		hostErrs := newConfigErrors(path)
+		config := parseConfiguration(gjson.ParseBytes(overlayConfiguration(jsonData, block)), hostErrs)
+		for _, message := range hostErrs.messages {
+			errs.messages = append(errs.messages, message)
+		}
+		switch {
+		case pattern == "*":
+			vhosts.fallback = &config
+		case wildcard:
+			vhosts.wildcards = append(vhosts.wildcards, wildcardVirtualHost{suffix: pattern[1:], config: &config})
+		default:
+			vhosts.exact[pattern] = &config
+		}
+		return true
+	})
+	// The most specific wildcard is tried first
+	sort.Slice(vhosts.wildcards, func(i, j int) bool {
+		return len(vhosts.wildcards[i].suffix) > len(vhosts.wildcards[j].suffix)
+	})
+	return vhosts
+}
 
-	return types.ActionContinue
+// These settings are replaced together by an overlay so that e.g. statusCodes in a virtual host
+// isn't rejected because the top level has a startStatusCode
+var overlayKeyGroups = [][]string{
+	{"statusCodes", "startStatusCode", "endStatusCode"},
+	{"problemTypeURIMap", "problemTypeBaseURI"},
 }
 
-// Override types.DefaultHttpContext.
-func (ctx *customErrorsContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
+// parseRouteConfig parses the JSON settings from the route metadata and overlays them on base, the
+// same settings as a virtual host block can be used as well as enabled to turn the transformation on or off
+func parseRouteConfig(base *pluginConfiguration, metadata string) (*routeConfig, error) {
+	if !gjson.Valid(metadata) {
+		return &routeConfig{}, fmt.Errorf("the route metadata is not a valid json: %q", metadata)
+	}
+	jsonData := gjson.Parse(metadata)
 
-	proxywasm.LogInfof("BEGIN OnHttpResponseHeaders")
-	var statusCode string
-	var statusCodeInt int
+	// enabled is honoured even when the other settings are invalid so that a typo
+	// can't turn the transformation back on for a route that asked for it to be off
+	route := &routeConfig{}
+	if enabled := jsonData.Get("enabled"); enabled.Type == gjson.True || enabled.Type == gjson.False {
+		value := enabled.Bool()
+		route.enabled = &value
+	}
 
-	statusCode, err := proxywasm.GetHttpResponseHeader(":status")
-	if err != nil {
-		proxywasm.LogErrorf("failed to get header status. Error: %v", err)
+	errs := newConfigErrors("$")
+	validateConfigurationTypes("$", jsonData, routeConfigurationSchema, errs)
+	if len(errs.messages) > 0 {
+		return route, errs
 	}
-	statusCodeInt, err = strconv.Atoi(statusCode)
-	if err != nil {
-		proxywasm.LogErrorf("failed to convert status code from string to int. Error: %v", err)
+	settings := 0
+	jsonData.ForEach(func(key, _ gjson.Result) bool {
+		if key.String() != "enabled" {
+			settings++
+		}
+		return true
+	})
+	if settings == 0 {
+		return route, nil
 	}
-	ctx.statusCode = statusCodeInt
-	proxywasm.LogInfof("status code int %v", statusCodeInt)
-
-	contentType, err := proxywasm.GetHttpResponseHeader("content-type")
-	if err != nil {
-		proxywasm.LogErrorf("failed to get content-type header. Error: %v", err)
+	// enabled is not a configuration setting so it isn't copied
+	config := parseConfiguration(gjson.ParseBytes(overlayConfiguration(base.document, jsonData, "enabled")), errs)
+	if len(errs.messages) > 0 {
+		return route, errs
 	}
+	route.config = &config
+	return route, nil
+}
 
-	// Only modify the response for the configured status codes AND if the request URL is one that we are intersted in
-	if statusCodeInt >= ctx.startStatusCode && statusCodeInt <= ctx.endStatusCode && MatchesTargetURLPrefixes(ctx.requestURL, ctx.targetURLPrefixes) {
-
-		if contentType == "application/problem+json" {
-			// The content type is already set correctly so assume the payload is of the right format and do nothing
-			return types.ActionContinue
+// overlayConfiguration returns the base configuration document with its top level settings replaced
+// by the ones in overlay, the virtualHosts, the routeMetadata and any excluded keys are not copied
+func overlayConfiguration(base gjson.Result, overlay gjson.Result, excluded ...string) []byte {
+	replaced := map[string]bool{"virtualHosts": true, "routeMetadata": true}
+	for _, key := range excluded {
+		replaced[key] = true
+	}
+	overlay.ForEach(func(key, _ gjson.Result) bool {
+		replaced[key.String()] = true
+		for _, group := range overlayKeyGroups {
+			if containsString(group, key.String()) {
+				for _, groupKey := range group {
+					replaced[groupKey] = true
+				}
+			}
 		}
+		return true
+	})
 
-		// Not sure how we can set this from OnHttpResponseBody so lets remove it
-		// since the content-length will be different when we replace the body
-		if err := proxywasm.RemoveHttpResponseHeader("content-length"); err != nil {
-			proxywasm.LogErrorf("failed to remove content length. Error: %v", err)
-			//panic(err)
+	var b strings.Builder
+	b.WriteByte('{')
+	write := func(key, value gjson.Result) bool {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(key.Raw)
+		b.WriteByte(':')
+		b.WriteString(value.Raw)
+		return true
+	}
+	base.ForEach(func(key, value gjson.Result) bool {
+		if replaced[key.String()] {
+			return true
+		}
+		return write(key, value)
+	})
+	overlay.ForEach(func(key, value gjson.Result) bool {
+		if containsString(excluded, key.String()) {
+			return true
 		}
+		return write(key, value)
+	})
+	b.WriteByte('}')
+	return []byte(b.String())
+}
 
-		err = proxywasm.ReplaceHttpResponseHeader("content-type", "application/problem+json")
-		if err != nil {
-			proxywasm.LogErrorf("failed to set content type to application/json. Error: %v", err)
-			return types.ActionContinue
+// parseRewriteRule parses the targetURLPrefixes and rollout settings of a rule, the top level
+// settings are parsed the same way for the default rule
+func parseRewriteRule(name string, path string, data gjson.Result, errs *configErrors) rewriteRule {
+	rule := rewriteRule{name: name, rolloutPercentage: 100}
+	for i, prefix := range data.Get("targetURLPrefixes").Array() {
+		if prefix.Str == "" {
+			errs.add(fmt.Sprintf("%s.targetURLPrefixes[%d]", path, i), "must not be empty, it would match every request")
 		}
-		ctx.modifyResponse = true
-		proxywasm.LogInfof("Response eligible for modification to rfc9457 format")
+		rule.targetURLPrefixes = append(rule.targetURLPrefixes, prefix.Str)
 	}
-
-	proxywasm.LogInfof("END OnHttpResponseHeaders")
-
-	return types.ActionContinue
+	if rollout := data.Get("rollout"); rollout.Exists() {
+		if percentage := rollout.Get("percentage"); percentage.Exists() {
+			rule.rolloutPercentage = percentage.Float()
+		}
+		if rule.rolloutPercentage < 0 || rule.rolloutPercentage > 100 {
+			errs.add(path+".rollout.percentage", "must be between 0 and 100: %s", rollout.Get("percentage").Raw)
+		}
+		rule.rolloutHashHeader = strings.ToLower(rollout.Get("hashHeader").String())
+		if rule.rolloutHashHeader != "" && !IsHeaderName(rule.rolloutHashHeader) {
+			errs.add(path+".rollout.hashHeader", "must be a header name: %q", rule.rolloutHashHeader)
+		}
+	}
+	for i, method := range data.Get("methods").Array() {
+		method := strings.ToUpper(method.String())
+		if method == "HEAD" {
+			errs.add(fmt.Sprintf("%s.methods[%d]", path, i), "responses to HEAD requests can't have a body")
+		}
+		rule.methods = append(rule.methods, method)
+	}
+	rule.requestHeaders = parseHeaderMatchers(path+".requestHeaders", data.Get("requestHeaders"), errs)
+	for i, contentType := range data.Get("contentTypes").Array() {
+		contentType := strings.ToLower(strings.TrimSpace(contentType.String()))
+		if family, subtype, ok := strings.Cut(contentType, "/"); !ok || family == "" || subtype == "" || family == "*" {
+			errs.add(fmt.Sprintf("%s.contentTypes[%d]", path, i), "must be a media type e.g. text/plain or text/*: %q", contentType)
+		}
+		rule.contentTypes = append(rule.contentTypes, contentType)
+	}
+	rule.responseHeaders = parseHeaderMatchers(path+".responseHeaders", data.Get("responseHeaders"), errs)
+	return rule
 }
 
-// Override types.DefaultHttpContext.
-// This does not get called when the status code is 404!
-// So this needs to be supplemented with a envoy filter that uses local_reply
-func (ctx *customErrorsContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
-	if !ctx.modifyResponse {
-		return types.ActionContinue
-	}
-	proxywasm.LogInfof("BEGIN OnHttpResponseBody")
-	ctx.totalResponseBodySize += bodySize
-	if !endOfStream {
-		// Wait until we see the entire body before modifying it.
-		return types.ActionPause
+// parseHeaderMatchers parses a list of header matchers, each one must have a name and exactly one condition
+func parseHeaderMatchers(path string, data gjson.Result, errs *configErrors) []headerMatcher {
+	var matchers []headerMatcher
+	for i, matcherData := range data.Array() {
+		matcherPath := fmt.Sprintf("%s[%d]", path, i)
+		matcher := headerMatcher{name: strings.ToLower(matcherData.Get("name").String())}
+		if matcher.name == "" {
+			errs.add(matcherPath+".name", "is required")
+		} else if !IsHeaderName(matcher.name) {
+			errs.add(matcherPath+".name", "must be a header name: %q", matcher.name)
+		}
+		conditions := 0
+		for _, match := range []string{headerMatchPresent, headerMatchExact, headerMatchPrefix, headerMatchRegex} {
+			if value := matcherData.Get(match); value.Exists() {
+				conditions++
+				matcher.match = match
+				matcher.value = value.String()
+			}
+		}
+		if conditions != 1 {
+			errs.add(matcherPath, "must have exactly one of present, exact, prefix or regex")
+		}
+		if matcher.match == headerMatchRegex {
+			regex, err := regexp.Compile(matcher.value)
+			if err != nil {
+				errs.add(matcherPath+".regex", "%v", err)
+			}
+			matcher.regex = regex
+		}
+		matchers = append(matchers, matcher)
 	}
+	return matchers
+}
 
-	originalBody, err := proxywasm.GetHttpResponseBody(0, ctx.totalResponseBodySize)
-	if err != nil {
-		proxywasm.LogErrorf("failed to get response body. Error: %v", err)
-		return types.ActionContinue
+// validateProblemTypeBaseURI checks that every URI generated from the problemTypeBaseURI will be valid
+func validateProblemTypeBaseURI(baseURI string) error {
+	if !strings.Contains(baseURI, "{status}") && !strings.Contains(baseURI, "{slug}") {
+		return fmt.Errorf("must contain {status} or {slug}: %q", baseURI)
+	}
+	// The placeholders are replaced with values that are always valid so any other brace is an error
+	if !IsURIReference(ExpandProblemTypeBaseURI(baseURI, "404")) {
+		return fmt.Errorf("%q is not a valid URI reference", baseURI)
 	}
+	return nil
+}
 
-	problemTypeURI := GetProblemTypeURI(strconv.Itoa(ctx.statusCode), ctx.problemTypeURIMap)
+// isErrorStatusCode returns true if key is a status code between 400 and 599 e.g. "404"
+func isErrorStatusCode(key string) bool {
+	statusCode, err := strconv.Atoi(key)
+	return err == nil && len(key) == 3 && statusCode >= 400 && statusCode <= 599
+}
 
-	response := &customErrorResponse{
-		Type:     problemTypeURI,
-		Title:    ctx.problemTitle,
-		Status:   ctx.statusCode,
-		TraceID:  ctx.traceID,
-		Instance: ctx.requestPath,
-		Detail:   string(originalBody),
+// isProblemTitleKey returns true if key is a status code between 400 and 599 or a problem type URI.
+// A relative URI has to start with / so that a mistyped status code e.g. 5O3 isn't taken for one.
+func isProblemTitleKey(key string) bool {
+	if isErrorStatusCode(key) {
+		return true
 	}
+	end := strings.IndexAny(key, ":/?#")
+	return IsURIReference(key) && end >= 0 && (key[end] == ':' || end == 0 && key[0] == '/')
+}
 
-	b, err := json.Marshal(response)
+// IsHeaderName returns true if name is an RFC 9110 field name, a token of letters, digits and !#$%&'*+-.^_`|~
+func IsHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// configErrors collects the problems found in the plugin configuration, each one is prefixed
+// with the JSON path of the offending value e.g. $.statusRemaps[0].from
+type configErrors struct {
+	// the path that $ refers to, the virtual hosts are parsed with their own root e.g. $.virtualHosts["example.com"]
+	root     string
+	messages []string
+	// only the first problem is reported for each path
+	paths map[string]bool
+}
+
+func newConfigErrors(root string) *configErrors {
+	return &configErrors{root: root, paths: make(map[string]bool)}
+}
+
+func (errs *configErrors) add(path string, format string, args ...interface{}) {
+	path = errs.root + strings.TrimPrefix(path, "$")
+	if errs.paths[path] {
+		return
+	}
+	errs.paths[path] = true
+	errs.messages = append(errs.messages, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (errs *configErrors) Error() string {
+	return "invalid plugin configuration: " + strings.Join(errs.messages, "; ")
+}
+
+// configKind is the JSON type expected for a configuration value
+type configKind int
+
+const (
+	configString configKind = iota
+	configBool
+	configNumber
+	configInteger
+	// an object with the listed fields, any other field is unknown
+	configObject
+	// an array where every item is elem
+	configArray
+	// an object with arbitrary keys where every value is elem
+	configMap
+)
+
+// configField describes a configuration value for validateConfigurationTypes
+type configField struct {
+	kind   configKind
+	fields map[string]*configField
+	elem   *configField
+	// null is allowed e.g. to remove a default
+	nullable bool
+}
+
+var (
+	configStringField  = &configField{kind: configString}
+	configBoolField    = &configField{kind: configBool}
+	configNumberField  = &configField{kind: configNumber}
+	configIntegerField = &configField{kind: configInteger}
+	configStringsField = &configField{kind: configArray, elem: configStringField}
+	configRolloutField = &configField{kind: configObject, fields: map[string]*configField{
+		"percentage": configNumberField,
+		"hashHeader": configStringField,
+	}}
+	configProblemTypeURIMapField      = &configField{kind: configMap, elem: &configField{kind: configString, nullable: true}}
+	configProblemTitlesField          = &configField{kind: configMap, elem: configStringField}
+	configLocalizedProblemTitlesField = &configField{kind: configMap, elem: configProblemTitlesField}
+	configHeaderMatchersField         = &configField{kind: configArray, elem: &configField{kind: configObject, fields: map[string]*configField{
+		"name":    configStringField,
+		"present": configBoolField,
+		"exact":   configStringField,
+		"prefix":  configStringField,
+		"regex":   configStringField,
+	}}}
+)
+
+// pluginConfigurationSchema lists every configuration key, it has to be updated whenever a key is added
+var pluginConfigurationSchema = &configField{kind: configObject, fields: map[string]*configField{
+	"targetURLPrefixes": configStringsField,
+	"rollout":           configRolloutField,
+	"methods":           configStringsField,
+	"requestHeaders":    configHeaderMatchersField,
+	"contentTypes":      configStringsField,
+	"responseHeaders":   configHeaderMatchersField,
+	"rules": {kind: configArray, elem: &configField{kind: configObject, fields: map[string]*configField{
+		"name":              configStringField,
+		"targetURLPrefixes": configStringsField,
+		"rollout":           configRolloutField,
+		"methods":           configStringsField,
+		"requestHeaders":    configHeaderMatchersField,
+		"contentTypes":      configStringsField,
+		"responseHeaders":   configHeaderMatchersField,
+	}}},
+	"statusCodes":            configStringField,
+	"startStatusCode":        configIntegerField,
+	"endStatusCode":          configIntegerField,
+	"problemTypeURIMap":      configProblemTypeURIMapField,
+	"problemTypeBaseURI":     configStringField,
+	"problemTitle":           configStringField,
+	"problemTitles":          configProblemTitlesField,
+	"localizedProblemTitles": configLocalizedProblemTitlesField,
+	"htmlErrorPages":         configBoolField,
+	"htmlTemplate":           configStringField,
+	"detailTemplate":         configStringField,
+	"statusRemaps": {kind: configArray, elem: &configField{kind: configObject, fields: map[string]*configField{
+		"name":              configStringField,
+		"from":              configIntegerField,
+		"to":                configIntegerField,
+		"responseFlags":     configStringsField,
+		"targetURLPrefixes": configStringsField,
+	}}},
+	"retryAfter": {kind: configObject, fields: map[string]*configField{
+		"statusCodes": {kind: configArray, elem: configIntegerField},
+		"seconds":     configIntegerField,
+	}},
+	"responseHeaderPolicy": {kind: configObject, fields: map[string]*configField{
+		"allow":               configStringsField,
+		"deny":                configStringsField,
+		"cacheControlNoStore": configBoolField,
+		"preserveCORS":        configBoolField,
+	}},
+	"traceIDHeader": {kind: configObject, fields: map[string]*configField{
+		"name":         configStringField,
+		"allResponses": configBoolField,
+	}},
+	"problemTypeLinkHeader": configBoolField,
+	"requestOverride": {kind: configObject, fields: map[string]*configField{
+		"header":       configStringField,
+		"secretHeader": configStringField,
+		"secret":       configStringField,
+		"allowDebug":   configBoolField,
+	}},
+	"errorID":      configStringField,
+	"timestamp":    configBoolField,
+	"mode":         configStringField,
+	"logLevel":     configStringField,
+	"logSampling":  {kind: configMap, elem: configIntegerField},
+	"virtualHosts": {kind: configMap, elem: &configField{kind: configObject, fields: overlaySchemaFields()}},
+	"routeMetadata": {kind: configObject, fields: map[string]*configField{
+		"namespace": configStringField,
+		"key":       configStringField,
+	}},
+}}
+
+// routeConfigurationSchema lists the settings that can be used in the route metadata
+var routeConfigurationSchema = &configField{kind: configObject, fields: overlaySchemaFields("enabled")}
+
+// overlaySchemaFields returns the settings that a virtual host or route can override
+// plus the extra boolean fields
+func overlaySchemaFields(boolFields ...string) map[string]*configField {
+	fields := map[string]*configField{
+		"statusCodes":            configStringField,
+		"startStatusCode":        configIntegerField,
+		"endStatusCode":          configIntegerField,
+		"problemTypeURIMap":      configProblemTypeURIMapField,
+		"problemTypeBaseURI":     configStringField,
+		"problemTitle":           configStringField,
+		"problemTitles":          configProblemTitlesField,
+		"localizedProblemTitles": configLocalizedProblemTitlesField,
+		"htmlErrorPages":         configBoolField,
+		"htmlTemplate":           configStringField,
+		"detailTemplate":         configStringField,
+	}
+	for _, name := range boolFields {
+		fields[name] = configBoolField
+	}
+	return fields
+}
+
+// validateConfigurationTypes reports unknown fields and values of the wrong type, gjson would
+// otherwise silently convert them e.g. a number in targetURLPrefixes becomes an empty prefix
+func validateConfigurationTypes(path string, value gjson.Result, field *configField, errs *configErrors) {
+	if field.nullable && value.Type == gjson.Null {
+		return
+	}
+	switch field.kind {
+	case configString:
+		if value.Type != gjson.String {
+			errs.add(path, "must be a string: %s", value.Raw)
+		}
+	case configBool:
+		if value.Type != gjson.True && value.Type != gjson.False {
+			errs.add(path, "must be a boolean: %s", value.Raw)
+		}
+	case configNumber:
+		if value.Type != gjson.Number {
+			errs.add(path, "must be a number: %s", value.Raw)
+		}
+	case configInteger:
+		if value.Type != gjson.Number || value.Float() != float64(value.Int()) {
+			errs.add(path, "must be an integer: %s", value.Raw)
+		}
+	case configObject:
+		if !value.IsObject() {
+			errs.add(path, "must be an object: %s", value.Raw)
+			return
+		}
+		value.ForEach(func(key, item gjson.Result) bool {
+			if itemField, ok := field.fields[key.String()]; ok {
+				validateConfigurationTypes(path+"."+key.String(), item, itemField, errs)
+			} else {
+				errs.add(path+"."+key.String(), "unknown field")
+			}
+			return true
+		})
+	case configArray:
+		if !value.IsArray() {
+			errs.add(path, "must be an array: %s", value.Raw)
+			return
+		}
+		for i, item := range value.Array() {
+			validateConfigurationTypes(fmt.Sprintf("%s[%d]", path, i), item, field.elem, errs)
+		}
+	case configMap:
+		if !value.IsObject() {
+			errs.add(path, "must be an object: %s", value.Raw)
+			return
+		}
+		value.ForEach(func(key, item gjson.Result) bool {
+			validateConfigurationTypes(fmt.Sprintf("%s[%q]", path, key.String()), item, field.elem, errs)
+			return true
+		})
+	}
+}
+
+// Override types.DefaultPluginContext.
+func (ctx *pluginContext) NewHttpContext(contextID uint32) types.HttpContext {
+	return &customErrorsContext{
+		pluginConfiguration: &ctx.configuration,
+		metrics:             ctx.metrics,
+		logger:              ctx.logger,
+		routeConfigs:        ctx.routeConfigs,
+		modifyResponse:      false,
+	}
+}
+
+// logLevel is the severity of a log record, the levels match the proxy's log levels
+type logLevel int
+
+const (
+	logLevelTrace logLevel = iota
+	logLevelDebug
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+	logLevelCritical
+)
+
+// logLevelNames are the values accepted by the logLevel setting
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+// parseLogLevel converts a logLevel setting to a logLevel
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(i), nil
+		}
+	}
+	return logLevelInfo, fmt.Errorf("logLevel must be one of %s: %q", strings.Join(logLevelNames, ", "), name)
+}
+
+// logRecord is written to the proxy log as a single line of JSON so that log pipelines can parse it
+type logRecord struct {
+	Event      string `json:"event"`
+	Message    string `json:"msg,omitempty"`
+	TraceID    string `json:"trace_id,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	DurationUs int64  `json:"duration_us,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// The problem document that would have been sent in shadow mode
+	Problem string `json:"problem,omitempty"`
+}
+
+// logger filters records by level before they are sent to the proxy and samples high volume events
+type logger struct {
+	level    logLevel
+	sampling map[string]uint64
+	// the number of records seen per sampled event
+	counts map[string]uint64
+}
+
+// newLogger returns a logger that drops records below level and only logs 1 in every N records for the sampled events
+func newLogger(level logLevel, sampling map[string]uint64) *logger {
+	return &logger{level: level, sampling: sampling, counts: make(map[string]uint64)}
+}
+
+// enabled returns true if records at this level are logged
+func (l *logger) enabled(level logLevel) bool {
+	return l != nil && level >= l.level
+}
+
+// log writes the record to the proxy log unless it is filtered out by level or sampling
+func (l *logger) log(level logLevel, record logRecord) {
+	if !l.enabled(level) {
+		return
+	}
+	if rate := l.sampling[record.Event]; rate > 1 {
+		count := l.counts[record.Event]
+		l.counts[record.Event] = count + 1
+		if count%rate != 0 {
+			return
+		}
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		proxywasm.LogErrorf("failed to marshal log record %s. Error: %v", record.Event, err)
+		return
+	}
+	switch level {
+	case logLevelTrace:
+		proxywasm.LogTrace(string(b))
+	case logLevelDebug:
+		proxywasm.LogDebug(string(b))
+	case logLevelInfo:
+		proxywasm.LogInfo(string(b))
+	case logLevelWarn:
+		proxywasm.LogWarn(string(b))
+	case logLevelError:
+		proxywasm.LogError(string(b))
+	default:
+		proxywasm.LogCritical(string(b))
+	}
+}
+
+// pluginMetrics holds the counters exposed through Envoy's stats. Every event is counted in an untagged
+// total e.g. problem_details.rewritten and in a tagged counter where the tags are encoded in the name e.g.
+// problem_details.rewritten.status_class.5xx.problem_type.<type>.rule.<rule>, the tags can be extracted
+// for Prometheus with Envoy's stats_tags (Istio's extraStatTags) regexes. The totals are defined when
+// the plugin starts and the tagged counters the first time they are used.
+//
+// The histograms record the size of the buffered error bodies, the size of the bodies that replace them
+// and the time spent building and committing the new body, so the buffering limits can be sized from data.
+type pluginMetrics struct {
+	counters map[string]proxywasm.MetricCounter
+
+	originalBodyBytes   proxywasm.MetricHistogram
+	outputBodyBytes     proxywasm.MetricHistogram
+	transformDurationUs proxywasm.MetricHistogram
+}
+
+// newPluginMetrics defines the untagged totals and the histograms
+func newPluginMetrics() *pluginMetrics {
+	m := &pluginMetrics{counters: make(map[string]proxywasm.MetricCounter)}
+	for _, name := range []string{metricErrorsSeen, metricRewritten, metricPassedThrough, metricSkipped, metricFailures, metricShadowRewritten} {
+		m.counter(metricPrefix + "." + name)
+	}
+	m.originalBodyBytes = proxywasm.DefineHistogramMetric(metricPrefix + "." + metricOriginalBodyBytes)
+	m.outputBodyBytes = proxywasm.DefineHistogramMetric(metricPrefix + "." + metricOutputBodyBytes)
+	m.transformDurationUs = proxywasm.DefineHistogramMetric(metricPrefix + "." + metricTransformDurationUs)
+	return m
+}
+
+// counter returns the counter with the given name, defining it on first use
+func (m *pluginMetrics) counter(name string) proxywasm.MetricCounter {
+	counter, ok := m.counters[name]
+	if !ok {
+		counter = proxywasm.DefineCounterMetric(name)
+		m.counters[name] = counter
+	}
+	return counter
+}
+
+// increment adds one to the total for the event and to the counter for the tags which are given as key, value pairs
+func (m *pluginMetrics) increment(event string, tags ...string) {
+	name := metricPrefix + "." + event
+	m.counter(name).Increment(1)
+	for i := 0; i+1 < len(tags); i += 2 {
+		name += "." + tags[i] + "." + MetricTagValue(tags[i+1])
+	}
+	if len(tags) > 0 {
+		m.counter(name).Increment(1)
+	}
+}
+
+// MetricTagValue makes a value such as a problem type URI safe to use in a metric name,
+// the scheme is dropped and anything other than letters, digits, - and _ is replaced by _
+func MetricTagValue(value string) string {
+	if i := strings.Index(value, "://"); i >= 0 {
+		value = value[i+3:]
+	}
+	if value == "" {
+		return "none"
+	}
+	b := []byte(value)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// customErrorResponse represents the information that will be included in the problem JSON response
+type customErrorResponse struct {
+	// type" (string) - A URI reference [RFC3986] that identifies the problem type.
+	Type string `json:"type"`
+	// "title" (string) - A short, human-readable summary of the problem type
+	// by default this is a single value for all types of errors, problemTitles and
+	// localizedProblemTitles can be used to set it per status code, problem type and language
+	Title string `json:"title"`
+	// The HTTP status code
+	Status int `json:"status"`
+	// This is just the request path
+	Instance string `json:"instance"`
+	// The trace id for the purpose of error correlation, usually the value of the W3C Traceparent header or the istio x-request-id header
+	// if neither are present in the request/response then use a static value
+	TraceID string `json:"trace_id"`
+	// The original error text returned by Istio, or the rendered detailTemplate
+	Detail string `json:"detail"`
+	// Extension member with the upstream status code when a statusRemaps rule changed it
+	OriginalStatus int `json:"original_status,omitempty"`
+	// Extension members for the retryAfter status codes so that clients can back off without parsing headers
+	RetryAfterSeconds  int    `json:"retry_after_seconds,omitempty"`
+	RateLimitLimit     string `json:"ratelimit_limit,omitempty"`
+	RateLimitRemaining string `json:"ratelimit_remaining,omitempty"`
+	RateLimitReset     string `json:"ratelimit_reset,omitempty"`
+	// Extension members that support teams can ask customers for, see errorID and timestamp
+	ErrorID   string `json:"error_id,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	// Diagnostics for trusted callers, see requestOverride.allowDebug
+	Debug *problemDebug `json:"debug,omitempty"`
+}
+
+// problemDebug is the debug extension member, it is only added when a caller with the
+// requestOverride secret asks for debug so internals are never exposed to untrusted callers
+type problemDebug struct {
+	Rule                string `json:"rule"`
+	ResponseFlags       string `json:"response_flags,omitempty"`
+	UpstreamCluster     string `json:"upstream_cluster,omitempty"`
+	OriginalContentType string `json:"original_content_type,omitempty"`
+	OriginalBodyBytes   int    `json:"original_body_bytes"`
+	TransformDurationUs int64  `json:"transform_duration_us"`
+}
+
+// customErrorsContext implements types.HttpContext interface of proxy-wasm-go SDK.
+type customErrorsContext struct {
+	// Embed the default root http context here,
+	// so that we don't need to reimplement all the methods.
+	types.DefaultHttpContext
+
+	// totalResponseBodySize
+	totalResponseBodySize int
+
+	// the requestURL - used to determine if we should modify the response or not
+	requestURL string
+	// the request path e.g. if the ur is `https://foo.com/bar` the path would be `/bar`
+	requestPath string
+	traceID     string
+	// the x-request-id, only read when the error id is derived from the trace id
+	requestID  string
+	statusCode int
+	// the status code before any statusRemaps rule was applied, zero when the status was not remapped
+	originalStatusCode int
+	// the Retry-After and rate limit values mirrored into the problem extension members
+	retryAfterSeconds  int
+	rateLimitLimit     string
+	rateLimitRemaining string
+	rateLimitReset     string
+	// the Accept and Accept-Language request headers, only kept when the settings may need them
+	accept         string
+	acceptLanguage string
+	// the languages from the Accept-Language request header in order of preference
+	languages []string
+	method    string
+	scheme    string
+	authority string
+
+	// the rules that matched the request, the first one that also matches the response is used
+	ruleCandidates []ruleCandidate
+	// the rule the request and response matched, nil when none matched
+	rule *rewriteRule
+	// false when the request matched a rule but is outside of the rule's rollout percentage
+	inRollout bool
+	// the accepted value of the requestOverride header, empty when there was none
+	override string
+	// where the route settings are read from, empty when routeMetadata is disabled
+	routeNamespace string
+	routeKey       string
+	// set when the route metadata turned the transformation on or off
+	routeEnabled *bool
+	// the upstream content-type, kept for the debug extension member
+	originalContentType string
+	// the name of the rule that made the response eligible for modification, empty when none matched
+	matchedRule string
+	// modifyResponse when true will result in the response being sent back in rfc9457 format
+	modifyResponse bool
+	// rewritten is true once the new body and headers have been committed
+	rewritten bool
+	// the copy of the response body kept in shadow mode
+	shadowResponseBody []byte
+	// the response headers as received from upstream and the headers that will replace them
+	// once the new body has been built
+	originalResponseHeaders [][2]string
+	pendingResponseHeaders  [][2]string
+	// renderHTML when true will result in the error being rendered as an HTML page instead of problem+json
+	renderHTML bool
+
+	// The plugin configuration is shared by every http context, it is embedded
+	// so that the settings can be read directly e.g. ctx.problemTitle
+	*pluginConfiguration
+	metrics      *pluginMetrics
+	logger       *logger
+	routeConfigs map[routeConfigKey]*routeConfig
+}
+
+// MatchesTargetURLPrefixes returns true if the request URL matches one of the targetURLPrefixes
+func MatchesTargetURLPrefixes(requestURL string, targetURLPrefixes []string) bool {
+	for _, prefix := range targetURLPrefixes {
+		if strings.Contains(requestURL, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandProblemTypeBaseURI replaces {status} in the problemTypeBaseURI with the status code and
+// {slug} with the slug of its IANA reason phrase e.g. https://errors.example.com/{slug} becomes
+// https://errors.example.com/not-found for a 404
+func ExpandProblemTypeBaseURI(baseURI string, statusCode string) string {
+	uri := strings.ReplaceAll(baseURI, "{status}", statusCode)
+	return strings.ReplaceAll(uri, "{slug}", ProblemTypeSlug(statusCode))
+}
+
+// ProblemTypeSlug returns the IANA reason phrase in lower case with hyphens e.g. too-many-requests,
+// status codes without a reason phrase use the status code
+func ProblemTypeSlug(statusCode string) string {
+	phrase, ok := defaultProblemTitles[statusCode]
+	if !ok {
+		return statusCode
+	}
+	var slug strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(phrase) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return slug.String()
+}
+
+// IsURIReference returns true if s is a URI reference as defined by RFC 3986 section 4.1, either a URI
+// with a scheme or a relative reference. Only the characters and percent-encodings are checked, not the
+// structure of the authority.
+func IsURIReference(s string) bool {
+	if s == "" {
+		return false
+	}
+	// A colon before the first /, ? or # is the end of the scheme, a relative
+	// reference can't have a colon in its first path segment
+	if end := strings.IndexAny(s, ":/?#"); end >= 0 && s[end] == ':' {
+		if !isURIScheme(s[:end]) {
+			return false
+		}
+	}
+	fragments := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return false
+			}
+			i += 2
+		case c == '#':
+			fragments++
+			if fragments > 1 {
+				return false
+			}
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+		case strings.IndexByte("-._~:/?[]@!$&'()*+,;=", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isURIScheme returns true if s is an RFC 3986 scheme, ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func isURIScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// statusSet is a bitmap of the status codes 400-599
+type statusSet [4]uint64
+
+func (set *statusSet) contains(statusCode int) bool {
+	if statusCode < 400 || statusCode > 599 {
+		return false
+	}
+	i := statusCode - 400
+	return set[i/64]&(1<<(i%64)) != 0
+}
+
+// addRange adds the status codes from start to end inclusive, anything outside of 400-599 is ignored
+func (set *statusSet) addRange(start int, end int) {
+	for statusCode := start; statusCode <= end; statusCode++ {
+		if statusCode < 400 || statusCode > 599 {
+			continue
+		}
+		i := statusCode - 400
+		set[i/64] |= 1 << (i % 64)
+	}
+}
+
+// ParseStatusSet parses a comma separated list of status codes (404), ranges (500-504) and classes (5xx),
+// any of which can be excluded with a ! prefix e.g. "4xx,!404". When there are only exclusions they
+// are removed from 400-599.
+func ParseStatusSet(expr string) (statusSet, error) {
+	var included, excluded statusSet
+	hasIncludes := false
+	for _, item := range strings.Split(expr, ",") {
+		item = strings.TrimSpace(item)
+		exclude := strings.HasPrefix(item, "!")
+		item = strings.TrimSpace(strings.TrimPrefix(item, "!"))
+		start, end, err := parseStatusRange(item)
+		if err != nil {
+			return statusSet{}, err
+		}
+		if exclude {
+			excluded.addRange(start, end)
+		} else {
+			included.addRange(start, end)
+			hasIncludes = true
+		}
+	}
+	if !hasIncludes {
+		included.addRange(400, 599)
+	}
+	for i := range included {
+		included[i] &^= excluded[i]
+	}
+	if included == (statusSet{}) {
+		return statusSet{}, fmt.Errorf("%q does not contain any status codes", expr)
+	}
+	return included, nil
+}
+
+// parseStatusRange parses one item of a status set without the ! prefix
+func parseStatusRange(item string) (int, int, error) {
+	if len(item) == 3 && (item[0] == '4' || item[0] == '5') && strings.EqualFold(item[1:], "xx") {
+		start := int(item[0]-'0') * 100
+		return start, start + 99, nil
+	}
+	startValue, endValue, isRange := strings.Cut(item, "-")
+	start, err := strconv.Atoi(strings.TrimSpace(startValue))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a status code, range or class", item)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.Atoi(strings.TrimSpace(endValue))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a status code, range or class", item)
+		}
+	}
+	if start < 400 || end > 599 {
+		return 0, 0, fmt.Errorf("%q is outside of 400-599", item)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("the range %q is empty", item)
+	}
+	return start, end, nil
+}
+
+// AddVary adds a header name to a Vary header value unless it is already listed or the value is *
+func AddVary(vary string, name string) string {
+	if strings.TrimSpace(vary) == "" {
+		return name
+	}
+	for _, listed := range strings.Split(vary, ",") {
+		listed = strings.TrimSpace(listed)
+		if listed == "*" || strings.EqualFold(listed, name) {
+			return vary
+		}
+	}
+	return vary + ", " + name
+}
+
+// FindRules returns the rules whose targetURLPrefixes, methods and request header matchers match
+// the request in order, lookupHeader returns the value of a request header and whether it was present
+func FindRules(requestURL string, method string, lookupHeader func(string) (string, bool), rules []rewriteRule) []*rewriteRule {
+	var matched []*rewriteRule
+	for i := range rules {
+		rule := &rules[i]
+		if !MatchesTargetURLPrefixes(requestURL, rule.targetURLPrefixes) {
+			continue
+		}
+		if len(rule.methods) > 0 && !containsString(rule.methods, method) {
+			continue
+		}
+		// CONNECT is used for tunnels so it is only matched when asked for explicitly
+		if len(rule.methods) == 0 && method == "CONNECT" {
+			continue
+		}
+		if !MatchesHeaders(rule.requestHeaders, lookupHeader) {
+			continue
+		}
+		matched = append(matched, rule)
+	}
+	return matched
+}
+
+// MatchesResponse returns true if the upstream content-type and the response headers match the rule
+func (rule *rewriteRule) MatchesResponse(contentType string, lookupHeader func(string) (string, bool)) bool {
+	if len(rule.contentTypes) > 0 && !MatchesContentType(contentType, rule.contentTypes) {
+		return false
+	}
+	return MatchesHeaders(rule.responseHeaders, lookupHeader)
+}
+
+// MatchesContentType returns true if the media type of the content-type, ignoring any parameters such as
+// the charset, is one of the families. A family is either a media type or a type with a * subtype e.g. text/*
+func MatchesContentType(contentType string, families []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, family := range families {
+		if prefix, ok := strings.CutSuffix(family, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == family {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesHeaders returns true if every matcher matches, lookupHeader returns the value of
+// a header and whether it was present
+func MatchesHeaders(matchers []headerMatcher, lookupHeader func(string) (string, bool)) bool {
+	for _, matcher := range matchers {
+		value, found := lookupHeader(matcher.name)
+		switch matcher.match {
+		case headerMatchPresent:
+			if found != (matcher.value == "true") {
+				return false
+			}
+		case headerMatchExact:
+			if !found || value != matcher.value {
+				return false
+			}
+		case headerMatchPrefix:
+			if !found || !strings.HasPrefix(value, matcher.value) {
+				return false
+			}
+		case headerMatchRegex:
+			if !found || !matcher.regex.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// InRollout returns true if the key falls within the percentage. The key is hashed so that
+// retries of the same request (same trace id or header value) always get the same decision.
+func InRollout(key string, percentage float64) bool {
+	if percentage >= 100 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// Buckets of 0.01% so that fractional percentages can be used
+	return float64(h.Sum64()%10000) < percentage*100
+}
+
+// RolloutKey returns the value hashed for the rollout decision. Only the trace-id field of a W3C
+// traceparent is used because the parent id changes from one attempt to the next.
+func RolloutKey(traceID string) string {
+	fields := strings.Split(traceID, "-")
+	if len(fields) == 4 {
+		return fields[1]
+	}
+	return traceID
+}
+
+// FindStatusRemap returns the first rule that applies to the response, responseFlags is
+// the comma separated list of Envoy response flags e.g. "UH,UO"
+func FindStatusRemap(statusCode int, requestURL string, responseFlags string, statusRemaps []statusRemap) (statusRemap, bool) {
+	flags := strings.Split(responseFlags, ",")
+	for _, remap := range statusRemaps {
+		if remap.from != statusCode {
+			continue
+		}
+		if len(remap.targetURLPrefixes) > 0 && !MatchesTargetURLPrefixes(requestURL, remap.targetURLPrefixes) {
+			continue
+		}
+		if len(remap.responseFlags) > 0 && !containsAny(flags, remap.responseFlags) {
+			continue
+		}
+		return remap, true
+	}
+	return statusRemap{}, false
+}
+
+// containsInt returns true if i is one of values
+func containsInt(values []int, i int) bool {
+	for _, v := range values {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny returns true if any of candidates is one of values
+func containsAny(values []string, candidates []string) bool {
+	for _, candidate := range candidates {
+		if containsString(values, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetProblemTypeURI returns the problem type URI for a specific status code
+func GetProblemTypeURI(statusCode string, problemTypeURIMap map[string]string) string {
+	problemTypeURI := ""
+	if val, ok := problemTypeURIMap[statusCode]; ok {
+		problemTypeURI = val
+	}
+
+	if problemTypeURI == "" && strings.HasPrefix(statusCode, "4") {
+		problemTypeURI = default4xxProblemTypeURI
+	} else if problemTypeURI == "" && strings.HasPrefix(statusCode, "5") {
+		problemTypeURI = default5xxProblemTypeURI
+	}
+	return problemTypeURI
+}
+
+// ParseAcceptLanguage returns the lower cased language tags from an Accept-Language header ordered
+// by their quality value, tags with q=0 and the * wildcard are dropped.
+func ParseAcceptLanguage(acceptLanguage string) []string {
+	type weightedLanguage struct {
+		tag     string
+		quality float64
+	}
+	var weighted []weightedLanguage
+	for _, languageRange := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(languageRange, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		weighted = append(weighted, weightedLanguage{tag: tag, quality: quality})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].quality > weighted[j].quality
+	})
+
+	languages := make([]string, 0, len(weighted))
+	for _, w := range weighted {
+		languages = append(languages, w.tag)
+	}
+	return languages
+}
+
+// GetProblemTitle returns the title for a status code and problem type. Localized titles are tried
+// first in the order of the callers language preferences, falling back from a regional tag such as
+// "de-ch" to its primary language "de". Problem type URIs take precedence over status codes.
+func GetProblemTitle(statusCode string, problemTypeURI string, languages []string, problemTitle string,
+	problemTitles map[string]string, localizedProblemTitles map[string]map[string]string) string {
+	for _, language := range languages {
+		candidates := []string{language}
+		if i := strings.Index(language, "-"); i > 0 {
+			candidates = append(candidates, language[:i])
+		}
+		for _, candidate := range candidates {
+			if title := lookupTitle(statusCode, problemTypeURI, localizedProblemTitles[candidate]); title != "" {
+				return title
+			}
+		}
+	}
+	if title := lookupTitle(statusCode, problemTypeURI, problemTitles); title != "" {
+		return title
+	}
+	return problemTitle
+}
+
+// lookupTitle returns the title for the problem type URI if there is one, otherwise the title for the status code
+func lookupTitle(statusCode string, problemTypeURI string, titles map[string]string) string {
+	if title := titles[problemTypeURI]; title != "" {
+		return title
+	}
+	return titles[statusCode]
+}
+
+// PrefersHTML returns true if the Accept header explicitly asks for text/html with a higher
+// quality value than any JSON media type, which is what browsers do on page navigation.
+// Clients that only send */* (curl, fetch, most SDKs) are not considered browsers.
+func PrefersHTML(accept string) bool {
+	htmlQuality, jsonQuality := -1.0, -1.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			if quality > htmlQuality {
+				htmlQuality = quality
+			}
+		case "application/problem+json", "application/json":
+			if quality > jsonQuality {
+				jsonQuality = quality
+			}
+		}
+	}
+	return htmlQuality > 0 && htmlQuality > jsonQuality
+}
+
+// RenderHTMLErrorPage fills the {{title}}, {{status}}, {{detail}}, {{instance}}, {{trace_id}} and {{type}}
+// variables in htmlTemplate. Every value is HTML escaped because the path and the detail are
+// controlled by the client and the upstream respectively.
+func RenderHTMLErrorPage(htmlTemplate *textTemplate, response *customErrorResponse) []byte {
+	variables := map[string]string{
+		"title":     response.Title,
+		"status":    strconv.Itoa(response.Status),
+		"detail":    response.Detail,
+		"instance":  response.Instance,
+		"trace_id":  response.TraceID,
+		"type":      response.Type,
+		"error_id":  response.ErrorID,
+		"timestamp": response.Timestamp,
+	}
+	return []byte(htmlTemplate.Render(variables, html.EscapeString))
+}
+
+// textTemplate is a minimal template language that works with TinyGo, text/template relies too heavily on reflection.
+// Variables are written as {{name}} or {{name|fallback}}, the fallback is used when the variable has no value.
+type textTemplate struct {
+	segments []templateSegment
+}
+
+// templateSegment is either literal text or a variable reference
+type templateSegment struct {
+	literal  string
+	variable string
+	fallback string
+}
+
+// parseTextTemplate compiles source and returns an error for unterminated or empty
+// variable references and for any variable that is not in allowedVariables
+func parseTextTemplate(source string, allowedVariables []string) (*textTemplate, error) {
+	compiled := &textTemplate{}
+	remaining := source
+	for {
+		start := strings.Index(remaining, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(remaining[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in template %q", source)
+		}
+		expression := remaining[start+2 : start+end]
+		name, fallback, _ := strings.Cut(expression, "|")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty variable in template %q", source)
+		}
+		if !containsString(allowedVariables, name) {
+			return nil, fmt.Errorf("unknown variable %q in template %q, valid variables are: %s",
+				name, source, strings.Join(allowedVariables, ", "))
+		}
+		if start > 0 {
+			compiled.segments = append(compiled.segments, templateSegment{literal: remaining[:start]})
+		}
+		compiled.segments = append(compiled.segments, templateSegment{variable: name, fallback: fallback})
+		remaining = remaining[start+end+2:]
+	}
+	if remaining != "" {
+		compiled.segments = append(compiled.segments, templateSegment{literal: remaining})
+	}
+	return compiled, nil
+}
+
+// Render returns the template with every variable replaced by its value passed through escape,
+// literal text is never escaped
+func (t *textTemplate) Render(variables map[string]string, escape func(string) string) string {
+	var sb strings.Builder
+	for _, segment := range t.segments {
+		if segment.variable == "" {
+			sb.WriteString(segment.literal)
+			continue
+		}
+		value := variables[segment.variable]
+		if value == "" {
+			value = segment.fallback
+		}
+		if escape != nil {
+			value = escape(value)
+		}
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
+
+// UsesVariable returns true if the template references the named variable
+func (t *textTemplate) UsesVariable(name string) bool {
+	for _, segment := range t.segments {
+		if segment.variable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns true if s is one of values
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseFlagsString converts Envoy's response flags bit-vector to the comma separated short names
+// used in the access logs, e.g. "UH,UO"
+func ResponseFlagsString(flags uint64) string {
+	var names []string
+	for i, name := range responseFlagNames {
+		if flags&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// logf logs a record for the event with the trace id, status and matched rule of the request,
+// the message is only formatted when the level is enabled
+func (ctx *customErrorsContext) logf(level logLevel, event string, err error, format string, args ...interface{}) {
+	if !ctx.logger.enabled(level) {
+		return
+	}
+	record := ctx.newLogRecord(event, err)
+	record.Message = fmt.Sprintf(format, args...)
+	ctx.logger.log(level, record)
+}
+
+// newLogRecord returns a record for the event with the trace id, status and matched rule of the request
+func (ctx *customErrorsContext) newLogRecord(event string, err error) logRecord {
+	record := logRecord{
+		Event:   event,
+		TraceID: ctx.traceID,
+		Status:  ctx.statusCode,
+		Rule:    ctx.matchedRule,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// getStringProperty returns an Envoy attribute as a string, or an empty string if it is not available
+func (ctx *customErrorsContext) getStringProperty(path ...string) string {
+	value, err := proxywasm.GetProperty(path)
+	if err != nil {
+		if err != types.ErrorStatusNotFound {
+			ctx.logf(logLevelError, "get_property_failed", err, "failed to get property %s", strings.Join(path, "."))
+		}
+		return ""
+	}
+	return string(value)
+}
+
+// getResponseFlags returns Envoy's response flags as the short names used in the access logs
+func (ctx *customErrorsContext) getResponseFlags() string {
+	value, err := proxywasm.GetProperty([]string{"response", "flags"})
+	if err != nil {
+		if err != types.ErrorStatusNotFound {
+			ctx.logf(logLevelError, "get_property_failed", err, "failed to get property response.flags")
+		}
+		return ""
+	}
+	if len(value) != 8 {
+		ctx.logf(logLevelError, "get_property_failed", nil, "unexpected size for property response.flags: %d", len(value))
+		return ""
+	}
+	return ResponseFlagsString(binary.LittleEndian.Uint64(value))
+}
+
+// getRequestHeader returns the request header value, a missing header is not an error
+func (ctx *customErrorsContext) getRequestHeader(key string) string {
+	value, err := proxywasm.GetHttpRequestHeader(key)
+	if err != nil && err != types.ErrorStatusNotFound {
+		ctx.logf(logLevelError, "get_request_header_failed", err, "failed to get request header %s", key)
+	}
+	return value
+}
+
+// applyRouteConfig applies the settings in the route metadata, they are parsed once per
+// configuration and cached because most requests are for a handful of routes. Reading the
+// metadata takes a host call per setting so it is only done for error responses.
+func (ctx *customErrorsContext) applyRouteConfig(namespace string, key string) {
+	metadata := ctx.readRouteMetadata(namespace, key)
+	if metadata == "" {
+		return
+	}
+	cacheKey := routeConfigKey{base: ctx.pluginConfiguration, metadata: metadata}
+	route, ok := ctx.routeConfigs[cacheKey]
+	if !ok {
+		var err error
+		route, err = parseRouteConfig(ctx.pluginConfiguration, metadata)
+		if err != nil {
+			ctx.logf(logLevelWarn, "route_config_invalid", err, "ignoring the settings in the route metadata")
+		}
+		if ctx.routeConfigs != nil && len(ctx.routeConfigs) < maxRouteConfigs {
+			ctx.routeConfigs[cacheKey] = route
+		}
+	}
+	if route.config != nil {
+		ctx.pluginConfiguration = route.config
+	}
+	ctx.routeEnabled = route.enabled
+}
+
+// readRouteMetadata returns the route settings as a JSON document. The settings are normally the fields
+// of the namespace's struct e.g. {"problem_details": {"enabled": false}}, they can also be a JSON string
+// in the key field e.g. {"problem_details": {"config": "{\"enabled\": false}"}} and the fields override it.
+// Envoy serializes a struct as protobuf so every setting is read on its own.
+func (ctx *customErrorsContext) readRouteMetadata(namespace string, key string) string {
+	document := ctx.getStringProperty("xds", "route_metadata", "filter_metadata", namespace, key)
+
+	names := make([]string, 0, len(routeConfigurationSchema.fields))
+	for name := range routeConfigurationSchema.fields {
+		names = append(names, name)
+	}
+	// Sorted so that the same settings always give the same document, it is the cache key
+	sort.Strings(names)
+	var fields strings.Builder
+	for _, name := range names {
+		value, err := proxywasm.GetProperty([]string{"xds", "route_metadata", "filter_metadata", namespace, name})
+		if err != nil {
+			if err != types.ErrorStatusNotFound {
+				ctx.logf(logLevelError, "get_property_failed", err, "failed to get the %s route metadata", name)
+			}
+			continue
+		}
+		field, err := RouteMetadataValueJSON(routeConfigurationSchema.fields[name].kind, value)
+		if err != nil {
+			ctx.logf(logLevelWarn, "route_config_invalid", err, "ignoring the %s route metadata", name)
+			continue
+		}
+		if fields.Len() > 0 {
+			fields.WriteByte(',')
+		}
+		fields.WriteString(strconv.Quote(name) + ":" + field)
+	}
+
+	if fields.Len() == 0 {
+		return document
+	}
+	overlay := gjson.Parse("{" + fields.String() + "}")
+	if document == "" || !gjson.Valid(document) {
+		return overlay.Raw
+	}
+	return string(overlayConfiguration(gjson.Parse(document), overlay))
+}
+
+// RouteMetadataValueJSON converts a route metadata value as serialized by Envoy to JSON. Booleans
+// are a single byte, numbers are a little endian double and strings are the raw bytes.
+// Maps can't be read from a struct so they have to be a JSON string.
+func RouteMetadataValueJSON(kind configKind, value []byte) (string, error) {
+	switch kind {
+	case configBool:
+		if len(value) != 1 {
+			return "", fmt.Errorf("expected a boolean, got %d bytes", len(value))
+		}
+		return strconv.FormatBool(value[0] != 0), nil
+	case configInteger, configNumber:
+		if len(value) != 8 {
+			return "", fmt.Errorf("expected a number, got %d bytes", len(value))
+		}
+		number := math.Float64frombits(binary.LittleEndian.Uint64(value))
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case configMap, configObject:
+		if !gjson.ValidBytes(value) || !gjson.ParseBytes(value).IsObject() {
+			return "", fmt.Errorf("expected a JSON object: %q", string(value))
+		}
+		return string(value), nil
+	}
+	encoded, err := json.Marshal(string(value))
+	return string(encoded), err
+}
+
+// lookupRequestHeader returns the value of a request header and whether it was present
+func (ctx *customErrorsContext) lookupRequestHeader(key string) (string, bool) {
+	value, err := proxywasm.GetHttpRequestHeader(key)
 	if err != nil {
-		proxywasm.LogErrorf("failed to marshal response struct to JSON. Error: %v", err)
-		return types.ActionContinue
+		if err != types.ErrorStatusNotFound {
+			ctx.logf(logLevelError, "get_request_header_failed", err, "failed to get request header %s", key)
+		}
+		return "", false
+	}
+	return value, true
+}
+
+// lookupResponseHeader returns the value of a response header and whether it was present
+func (ctx *customErrorsContext) lookupResponseHeader(key string) (string, bool) {
+	value, err := proxywasm.GetHttpResponseHeader(key)
+	if err != nil {
+		if err != types.ErrorStatusNotFound {
+			ctx.logf(logLevelError, "get_response_header_failed", err, "failed to get response header %s", key)
+		}
+		return "", false
+	}
+	return value, true
+}
+
+// readRequestOverride returns the value of the requestOverride header, or an empty string when the
+// header is missing, has an unknown value or the shared secret does not match
+func (ctx *customErrorsContext) readRequestOverride() string {
+	var providedSecret string
+	if ctx.requestOverride.secretHeader != "" {
+		providedSecret = ctx.getRequestHeader(ctx.requestOverride.secretHeader)
+		// The secret must never reach the upstream
+		if providedSecret != "" {
+			if err := proxywasm.RemoveHttpRequestHeader(ctx.requestOverride.secretHeader); err != nil {
+				ctx.logf(logLevelError, "remove_request_header_failed", err, "failed to remove the %s request header", ctx.requestOverride.secretHeader)
+			}
+		}
+	}
+
+	value := strings.ToLower(strings.TrimSpace(ctx.getRequestHeader(ctx.requestOverride.header)))
+	if value == "" {
+		return ""
+	}
+	if value != requestOverrideOff && value != requestOverrideOn && value != requestOverrideDebug {
+		ctx.logf(logLevelDebug, "request_override_ignored", nil, "ignoring unknown %s value %q", ctx.requestOverride.header, value)
+		return ""
+	}
+	if ctx.requestOverride.secret != "" && subtle.ConstantTimeCompare([]byte(providedSecret), []byte(ctx.requestOverride.secret)) != 1 {
+		ctx.logf(logLevelWarn, "request_override_rejected", nil, "ignoring %s because the secret does not match", ctx.requestOverride.header)
+		return ""
+	}
+	ctx.logf(logLevelDebug, "request_override", nil, "%s set to %s", ctx.requestOverride.header, value)
+	return value
+}
+
+// renderProblemTemplate renders a title or the detail template. Envoy attributes are only fetched
+// from the host when the template needs them.
+func (ctx *customErrorsContext) renderProblemTemplate(source string, body []byte) string {
+	compiled, ok := ctx.templates[source]
+	if !ok {
+		return source
+	}
+	variables := map[string]string{
+		"method":    ctx.method,
+		"scheme":    ctx.scheme,
+		"authority": ctx.authority,
+		"path":      ctx.requestPath,
+		"status":    strconv.Itoa(ctx.statusCode),
+		"trace_id":  ctx.traceID,
+		"body":      string(body),
+	}
+	if compiled.UsesVariable("upstream_cluster") {
+		variables["upstream_cluster"] = ctx.getStringProperty("xds", "cluster_name")
+	}
+	if compiled.UsesVariable("response_flags") {
+		variables["response_flags"] = ctx.getResponseFlags()
+	}
+	if compiled.UsesVariable("response_code_details") {
+		variables["response_code_details"] = ctx.getStringProperty("response", "code_details")
+	}
+	return compiled.Render(variables, nil)
+}
+
+// Override types.DefaultHttpContext.
+func (ctx *customErrorsContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
+
+	var requestURL string
+	var traceID string
+
+	scheme := ctx.getRequestHeader(":scheme")
+	authority := ctx.getRequestHeader(":authority")
+	path := ctx.getRequestHeader(":path")
+	method := ctx.getRequestHeader(":method")
+
+	// Everything below uses the settings of the virtual host, the route metadata settings are only in the
+	// top level configuration. The route settings are only read once the response is an error, see applyRouteConfig.
+	ctx.routeNamespace, ctx.routeKey = ctx.routeMetadataNamespace, ctx.routeMetadataKey
+	if config := ctx.virtualHosts.find(authority); config != nil {
+		ctx.pluginConfiguration = config
+	}
+
+	// If the W3C traceparent header is not present use the istio x-request-id instead
+	traceID = ctx.getRequestHeader("traceparent")
+	if traceID == "" {
+		traceID = ctx.getRequestHeader("x-request-id")
+		// If that is also missing then use the default trace id
+		if traceID == "" {
+			ctx.logf(logLevelDebug, "default_trace_id", nil, "traceparent and x-request-id request headers missing, will use the default trace id")
+			traceID = defaultTraceID
+		}
+	}
+
+	// Retries of a traceparent share the trace id, the x-request-id tells them apart
+	if ctx.errorIDMode == errorIDModeTrace {
+		ctx.requestID = ctx.getRequestHeader("x-request-id")
+	}
+
+	// The request headers can't be read once the response has started so the ones that the
+	// settings of an error response may need are kept, a route may turn either setting on
+	if ctx.htmlErrorPages || ctx.routeNamespace != "" {
+		ctx.accept = ctx.getRequestHeader("accept")
+	}
+	if len(ctx.localizedProblemTitles) > 0 || ctx.routeNamespace != "" {
+		ctx.acceptLanguage = ctx.getRequestHeader("accept-language")
+	}
+
+	requestURL = fmt.Sprintf("%s://%s%s", scheme, authority, path)
+
+	ctx.method = method
+	ctx.scheme = scheme
+	ctx.authority = authority
+	ctx.requestURL = requestURL
+	ctx.requestPath = path
+	ctx.traceID = traceID
+
+	ctx.logf(logLevelDebug, "request_headers", nil, "request url: %s", requestURL)
+
+	for _, rule := range FindRules(requestURL, method, ctx.lookupRequestHeader, ctx.rules) {
+		var key string
+		if rule.rolloutHashHeader != "" {
+			key = ctx.getRequestHeader(rule.rolloutHashHeader)
+		}
+		// Every request without a trace id has the default one, hashing it would put all of them in the same bucket
+		if key == "" && traceID != defaultTraceID {
+			key = RolloutKey(traceID)
+		}
+		inRollout := rule.rolloutPercentage >= 100
+		if key != "" {
+			inRollout = InRollout(key, rule.rolloutPercentage)
+		} else if !inRollout {
+			ctx.logf(logLevelDebug, "rollout_without_key", nil, "no trace id or %s header to hash, request is outside of the rollout of rule %s", rule.rolloutHashHeader, rule.name)
+		}
+		ctx.ruleCandidates = append(ctx.ruleCandidates, ruleCandidate{rule: rule, inRollout: inRollout})
+	}
+
+	if ctx.requestOverride.header != "" {
+		ctx.override = ctx.readRequestOverride()
 	}
 
-	err = proxywasm.ReplaceHttpResponseBody(b)
+	return types.ActionContinue
+}
+
+// Override types.DefaultHttpContext.
+func (ctx *customErrorsContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
+
+	var statusCode string
+	var statusCodeInt int
+
+	statusCode, err := proxywasm.GetHttpResponseHeader(":status")
+	if err != nil {
+		ctx.logf(logLevelError, "get_response_header_failed", err, "failed to get header status")
+	}
+	statusCodeInt, err = strconv.Atoi(statusCode)
 	if err != nil {
-		proxywasm.LogErrorf("failed to replace response body. Error: %v", err)
+		ctx.logf(logLevelError, "invalid_status", err, "failed to convert status code %q from string to int", statusCode)
+	}
+	ctx.statusCode = statusCodeInt
+	ctx.logf(logLevelDebug, "response_headers", nil, "response headers received")
+
+	// A route can change which status codes are rewritten so its settings are read for any error
+	if ctx.routeNamespace != "" && statusCodeInt >= 400 && statusCodeInt <= 599 {
+		ctx.applyRouteConfig(ctx.routeNamespace, ctx.routeKey)
+	}
+
+	// Rewritten errors get the header with the rest of the pending headers, or when the body
+	// can't be rewritten once OnHttpResponseBody gives up
+	defer func() {
+		if !ctx.modifyResponse {
+			ctx.setTraceIDHeader()
+		}
+	}()
+
+	contentType, err := proxywasm.GetHttpResponseHeader("content-type")
+	if err != nil && err != types.ErrorStatusNotFound {
+		ctx.logf(logLevelError, "get_response_header_failed", err, "failed to get content-type header")
+	}
+
+	inStatusRange := ctx.statusCodes.contains(statusCodeInt)
+	if inStatusRange {
+		// Deferred so that it reflects any status remapping, it is updated again once the body is rewritten
+		defer ctx.setFilterState()
+		forced := ctx.override == requestOverrideOn || ctx.override == requestOverrideDebug
+		for _, candidate := range ctx.ruleCandidates {
+			if candidate.rule.MatchesResponse(contentType, ctx.lookupResponseHeader) {
+				ctx.rule = candidate.rule
+				ctx.inRollout = candidate.inRollout
+				break
+			}
+		}
+		if ctx.rule != nil {
+			ctx.matchedRule = ctx.rule.name
+		} else if forced {
+			ctx.matchedRule = requestOverrideRuleName
+		} else if ctx.routeEnabled != nil && *ctx.routeEnabled {
+			ctx.matchedRule = routeRuleName
+			ctx.inRollout = true
+		}
+		ctx.countMetric(metricErrorsSeen)
+		if ctx.matchedRule == "" {
+			ctx.countMetric(metricSkipped)
+		} else if ctx.method == "HEAD" {
+			// The response to a HEAD request never has a body even when it has a content-length
+			ctx.logf(logLevelDebug, "head_request", nil, "response to a HEAD request, skipping the modification to rfc9457 format")
+			ctx.countMetric(metricSkipped)
+			return types.ActionContinue
+		} else if ctx.override == requestOverrideOff {
+			ctx.logf(logLevelDebug, "request_override_off", nil, "transformation turned off by the %s request header", ctx.requestOverride.header)
+			ctx.countMetric(metricSkipped)
+			return types.ActionContinue
+		} else if ctx.routeEnabled != nil && !*ctx.routeEnabled && !forced {
+			ctx.logf(logLevelDebug, "route_disabled", nil, "transformation turned off by the route metadata")
+			ctx.countMetric(metricSkipped)
+			return types.ActionContinue
+		} else if !ctx.inRollout && !forced {
+			ctx.logf(logLevelDebug, "rollout_excluded", nil, "request is outside of the %v%% rollout of rule %s", ctx.rule.rolloutPercentage, ctx.matchedRule)
+			ctx.countMetric(metricSkipped)
+			return types.ActionContinue
+		}
+	}
+
+	// Only modify the response for the configured status codes AND if the request URL is one that we are intersted in
+	if inStatusRange && ctx.matchedRule != "" {
+
+		if MatchesContentType(contentType, []string{"application/problem+json"}) {
+			// The content type is already set correctly (parameters such as charset are ignored)
+			// so assume the payload is of the right format and do nothing
+			ctx.countMetric(metricPassedThrough)
+			return types.ActionContinue
+		}
+
+		if endOfStream {
+			// OnHttpResponseBody is never called for a response without a body so there is nothing to replace
+			ctx.logf(logLevelDebug, "response_without_body", nil, "response has no body, skipping the modification to rfc9457 format")
+			ctx.countMetric(metricSkipped)
+			return types.ActionContinue
+		}
+
+		// Nothing is changed on the response yet, the new headers are prepared here and only committed
+		// together with the new body so that a failure leaves the original response intact
+		ctx.originalResponseHeaders, err = proxywasm.GetHttpResponseHeaders()
+		if err != nil {
+			ctx.logf(logLevelError, "read_headers_failed", err, "failed to get response headers")
+			ctx.countFailure(failureStageReadHeaders)
+			return types.ActionContinue
+		}
+		ctx.pendingResponseHeaders = cloneHeaders(ctx.originalResponseHeaders)
+		ctx.originalContentType = contentType
+
+		// Only browsers get the HTML error page, everyone else gets problem+json
+		ctx.renderHTML = ctx.htmlErrorPages && PrefersHTML(ctx.accept)
+		// Only needed to pick a localized title
+		if len(ctx.localizedProblemTitles) > 0 {
+			ctx.languages = ParseAcceptLanguage(ctx.acceptLanguage)
+		}
+
+		newContentType := "application/problem+json"
+		if ctx.renderHTML {
+			newContentType = "text/html; charset=utf-8"
+		}
+		ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, "content-type", newContentType)
+		ctx.modifyResponse = true
+		ctx.logf(logLevelInfo, "response_eligible", nil, "Response eligible for modification to rfc9457 format")
+
+		if len(ctx.statusRemaps) > 0 {
+			ctx.remapStatus()
+		}
+		if containsInt(ctx.retryAfterStatusCodes, ctx.statusCode) {
+			ctx.synthesizeRetryAfter()
+		}
+		// Has to run after the headers have been read but before our own headers are added
+		ctx.applyResponseHeaderPolicy()
+		if ctx.htmlErrorPages {
+			// The body depends on the Accept header so shared caches must not mix the HTML and JSON versions
+			vary := AddVary(getHeader(ctx.pendingResponseHeaders, "vary"), "Accept")
+			ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, "vary", vary)
+		}
+		if ctx.traceIDHeader != "" {
+			ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, ctx.traceIDHeader, ctx.traceID)
+		}
+
+		if ctx.mode == modeShadow {
+			return types.ActionContinue
+		}
+		// Hold the headers until OnHttpResponseBody has built the new body
+		return types.ActionPause
+	}
+
+	return types.ActionContinue
+}
+
+// countMetric increments the counter for the event tagged with the status class, problem type and matched rule
+func (ctx *customErrorsContext) countMetric(event string, tags ...string) {
+	if ctx.metrics == nil {
+		return
+	}
+	statusCode := strconv.Itoa(ctx.statusCode)
+	statusClass := statusCode[:1] + "xx"
+	problemTypeURI := GetProblemTypeURI(statusCode, ctx.problemTypeURIMap)
+	rule := ctx.matchedRule
+	if rule == "" {
+		rule = noRuleName
+	}
+	tags = append([]string{"status_class", statusClass, "problem_type", problemTypeURI, "rule", rule}, tags...)
+	ctx.metrics.increment(event, tags...)
+}
+
+// setFilterState records what the plugin decided for an error response in Envoy's filter state so that
+// access logs and telemetry can refer to it e.g. %FILTER_STATE(wasm.problem_details.type:PLAIN)%.
+// The proxy-wasm ABI has no way to write dynamic metadata so filter state is the only option.
+func (ctx *customErrorsContext) setFilterState() {
+	statusCode := strconv.Itoa(ctx.statusCode)
+	originalStatusCode := statusCode
+	if ctx.originalStatusCode != 0 {
+		originalStatusCode = strconv.Itoa(ctx.originalStatusCode)
+		// In shadow mode the client gets the upstream status, the remapped one is only in the shadow_rewrite record
+		if ctx.mode == modeShadow {
+			statusCode = originalStatusCode
+		}
+	}
+	rule := ctx.matchedRule
+	if rule == "" {
+		rule = noRuleName
+	}
+	for key, value := range map[string]string{
+		filterStateProblemType:    GetProblemTypeURI(statusCode, ctx.problemTypeURIMap),
+		filterStateRule:           rule,
+		filterStateOriginalStatus: originalStatusCode,
+		filterStateRewritten:      strconv.FormatBool(ctx.rewritten),
+	} {
+		if value == "" {
+			continue
+		}
+		if err := proxywasm.SetProperty([]string{key}, []byte(value)); err != nil {
+			ctx.logf(logLevelError, "set_filter_state_failed", err, "failed to set filter state %s", key)
+		}
+	}
+}
+
+// setTraceIDHeader adds the trace id header to a response that is passed through unchanged
+// when it is enabled for all responses
+func (ctx *customErrorsContext) setTraceIDHeader() {
+	if !ctx.traceIDHeaderAllResponses || ctx.mode == modeShadow {
+		return
+	}
+	if err := proxywasm.ReplaceHttpResponseHeader(ctx.traceIDHeader, ctx.traceID); err != nil {
+		ctx.logf(logLevelError, "set_response_header_failed", err, "failed to set the %s header", ctx.traceIDHeader)
+	}
+}
+
+// countFailure increments the failures counter for the stage that failed
+func (ctx *customErrorsContext) countFailure(stage string) {
+	ctx.countMetric(metricFailures, "stage", stage)
+}
+
+// remapStatus applies the first matching statusRemaps rule to the pending :status header, the original
+// status is kept so it can be reported in the original_status extension member
+func (ctx *customErrorsContext) remapStatus() {
+	var responseFlags string
+	for _, remap := range ctx.statusRemaps {
+		if len(remap.responseFlags) > 0 {
+			responseFlags = ctx.getResponseFlags()
+			break
+		}
+	}
+	remap, ok := FindStatusRemap(ctx.statusCode, ctx.requestURL, responseFlags, ctx.statusRemaps)
+	if !ok {
+		return
+	}
+	ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, ":status", strconv.Itoa(remap.to))
+	ctx.logf(logLevelInfo, "status_remapped", nil, "status %d remapped to %d by rule %s", ctx.statusCode, remap.to, remap.name)
+	ctx.originalStatusCode = ctx.statusCode
+	ctx.statusCode = remap.to
+}
+
+// synthesizeRetryAfter makes sure the response says when to retry. An upstream Retry-After in
+// delta-seconds is kept, otherwise it is derived from x-ratelimit-reset and finally from the configured
+// number of seconds. The rate limit headers are kept so they can be mirrored in the problem document.
+func (ctx *customErrorsContext) synthesizeRetryAfter() {
+	ctx.rateLimitLimit = getHeader(ctx.originalResponseHeaders, "x-ratelimit-limit")
+	ctx.rateLimitRemaining = getHeader(ctx.originalResponseHeaders, "x-ratelimit-remaining")
+	ctx.rateLimitReset = getHeader(ctx.originalResponseHeaders, "x-ratelimit-reset")
+
+	if retryAfter := getHeader(ctx.originalResponseHeaders, "retry-after"); retryAfter != "" {
+		// An HTTP-date is passed through as is but can't be mirrored as a number of seconds
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			ctx.retryAfterSeconds = seconds
+		}
+		return
+	}
+
+	seconds := ctx.defaultRetryAfterSeconds
+	if reset, err := strconv.Atoi(ctx.rateLimitReset); err == nil && reset > 0 {
+		seconds = reset
+	} else if getHeader(ctx.originalResponseHeaders, "x-envoy-ratelimited") != "" {
+		ctx.logf(logLevelDebug, "envoy_rate_limited", nil, "response rate limited by envoy, using the configured retry after of %d seconds", seconds)
+	}
+	if seconds <= 0 {
+		return
+	}
+	ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, "retry-after", strconv.Itoa(seconds))
+	ctx.retryAfterSeconds = seconds
+}
+
+// applyResponseHeaderPolicy removes the headers the responseHeaderPolicy doesn't allow and sets cache-control
+func (ctx *customErrorsContext) applyResponseHeaderPolicy() {
+	policy := ctx.responseHeaderPolicy
+	for _, name := range HeadersToRemove(ctx.pendingResponseHeaders, policy) {
+		ctx.pendingResponseHeaders = removeHeader(ctx.pendingResponseHeaders, name)
+	}
+	if policy.cacheControlNoStore {
+		ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, "cache-control", "no-store")
+	}
+}
+
+// HeadersToRemove returns the names of the headers that the policy does not allow on an error response
+func HeadersToRemove(headers [][2]string, policy responseHeaderPolicy) []string {
+	var remove []string
+	for _, header := range headers {
+		name := strings.ToLower(header[0])
+		if strings.HasPrefix(name, ":") || containsString(remove, name) {
+			continue
+		}
+		switch name {
+		case "content-type", "content-length", "retry-after":
+			continue
+		}
+		if policy.preserveCORS && strings.HasPrefix(name, "access-control-") {
+			continue
+		}
+		if matchesHeaderPattern(name, policy.deny) || (len(policy.allow) > 0 && !matchesHeaderPattern(name, policy.allow)) {
+			remove = append(remove, name)
+		}
+	}
+	return remove
+}
+
+// matchesHeaderPattern returns true if the header name equals one of the patterns
+// or starts with a pattern that ends in *
+func matchesHeaderPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == name || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// setContentLength sets the content-length of the new body for HTTP/1.x downstreams. Other protocols
+// frame the body themselves so the now incorrect upstream content-length is simply removed.
+func (ctx *customErrorsContext) setContentLength(size int) {
+	if strings.HasPrefix(ctx.getStringProperty("request", "protocol"), "HTTP/1") {
+		ctx.pendingResponseHeaders = setHeader(ctx.pendingResponseHeaders, "content-length", strconv.Itoa(size))
+		return
+	}
+	ctx.pendingResponseHeaders = removeHeader(ctx.pendingResponseHeaders, "content-length")
+}
+
+// commitResponse replaces the body and then the paused headers. The headers are only touched once the
+// body has been replaced, if they can't be replaced they are still the upstream ones so the original body
+// is put back and the client gets the upstream response rather than a body that doesn't match its headers.
+func (ctx *customErrorsContext) commitResponse(originalBody []byte, newBody []byte) bool {
+	if err := replaceResponseBody(newBody); err != nil {
+		ctx.logf(logLevelError, "commit_failed", err, "failed to replace response body")
+		return false
+	}
+	if err := replaceResponseHeaders(ctx.pendingResponseHeaders); err != nil {
+		ctx.logf(logLevelError, "commit_failed", err, "failed to replace response headers, restoring the original body")
+		if err := replaceResponseBody(originalBody); err != nil {
+			ctx.logf(logLevelCritical, "restore_failed", err, "failed to restore the original response body")
+		}
+		return false
+	}
+	return true
+}
+
+// NewErrorID returns a 32 character hex id. In "trace" mode it is derived from the trace id, the
+// x-request-id and the time of the error to the nanosecond, so retries that share a traceparent get
+// different ids, otherwise it is random. Requests without a trace id all have the default one so
+// they get a random id in either mode.
+func NewErrorID(mode string, traceID string, requestID string, now time.Time) (string, error) {
+	if mode == errorIDModeTrace && traceID != defaultTraceID {
+		sum := sha256.Sum256([]byte(traceID + "|" + requestID + "|" + now.UTC().Format(time.RFC3339Nano)))
+		return hex.EncodeToString(sum[:16]), nil
+	}
+	id := make([]byte, 16)
+	if _, err := randomRead(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// getHeader returns the value of the first header with the given name or an empty string
+func getHeader(headers [][2]string, key string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header[0], key) {
+			return header[1]
+		}
+	}
+	return ""
+}
+
+// setHeader sets the value of the first header with the given name, keeping its position, and removes
+// any other header with that name. The header is appended when it is not present.
+func setHeader(headers [][2]string, key string, value string) [][2]string {
+	for i, header := range headers {
+		if strings.EqualFold(header[0], key) {
+			headers[i][1] = value
+			return append(headers[:i+1], removeHeader(headers[i+1:], key)...)
+		}
+	}
+	return append(headers, [2]string{key, value})
+}
+
+// removeHeader returns the headers without any header with the given name
+func removeHeader(headers [][2]string, key string) [][2]string {
+	kept := headers[:0]
+	for _, header := range headers {
+		if !strings.EqualFold(header[0], key) {
+			kept = append(kept, header)
+		}
+	}
+	return kept
+}
+
+// cloneHeaders returns a copy of headers that can be changed without affecting the original
+func cloneHeaders(headers [][2]string) [][2]string {
+	return append([][2]string(nil), headers...)
+}
+
+// Override types.DefaultHttpContext.
+// This does not get called when the status code is 404!
+// So this needs to be supplemented with a envoy filter that uses local_reply
+func (ctx *customErrorsContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
+	if !ctx.modifyResponse {
+		return types.ActionContinue
+	}
+	ctx.totalResponseBodySize += bodySize
+
+	var originalBody []byte
+	var err error
+	if ctx.mode == modeShadow {
+		// The response is streamed untouched so each chunk is copied as it goes past
+		chunk, err := proxywasm.GetHttpResponseBody(0, bodySize)
+		if err != nil {
+			ctx.logf(logLevelError, "read_body_failed", err, "failed to get response body")
+			ctx.countFailure(failureStageReadBody)
+			ctx.modifyResponse = false
+			return types.ActionContinue
+		}
+		ctx.shadowResponseBody = append(ctx.shadowResponseBody, chunk...)
+		if !endOfStream {
+			return types.ActionContinue
+		}
+		originalBody = ctx.shadowResponseBody
+	} else {
+		if !endOfStream {
+			// Wait until we see the entire body before modifying it.
+			return types.ActionPause
+		}
+		originalBody, err = proxywasm.GetHttpResponseBody(0, ctx.totalResponseBodySize)
+		if err != nil {
+			ctx.logf(logLevelError, "read_body_failed", err, "failed to get response body")
+			ctx.countFailure(failureStageReadBody)
+			ctx.setTraceIDHeader()
+			return types.ActionContinue
+		}
+	}
+	start := nowFunc()
+	if ctx.metrics != nil {
+		ctx.metrics.originalBodyBytes.Record(uint64(len(originalBody)))
+	}
+
+	statusCode := strconv.Itoa(ctx.statusCode)
+	problemTypeURI := GetProblemTypeURI(statusCode, ctx.problemTypeURIMap)
+	problemTitle := GetProblemTitle(statusCode, problemTypeURI, ctx.languages, ctx.problemTitle, ctx.problemTitles, ctx.localizedProblemTitles)
+
+	detail := string(originalBody)
+	if ctx.detailTemplate != "" {
+		detail = ctx.renderProblemTemplate(ctx.detailTemplate, originalBody)
+	}
+
+	response := &customErrorResponse{
+		Type:               problemTypeURI,
+		Title:              ctx.renderProblemTemplate(problemTitle, originalBody),
+		Status:             ctx.statusCode,
+		TraceID:            ctx.traceID,
+		Instance:           ctx.requestPath,
+		Detail:             detail,
+		OriginalStatus:     ctx.originalStatusCode,
+		RetryAfterSeconds:  ctx.retryAfterSeconds,
+		RateLimitLimit:     ctx.rateLimitLimit,
+		RateLimitRemaining: ctx.rateLimitRemaining,
+		RateLimitReset:     ctx.rateLimitReset,
+	}
+
+	now := nowFunc()
+	if ctx.includeTimestamp {
+		response.Timestamp = now.UTC().Format(time.RFC3339)
+	}
+	if ctx.errorIDMode != "" {
+		// The error id is optional so a failure shouldn't stop the response being transformed
+		response.ErrorID, err = NewErrorID(ctx.errorIDMode, ctx.traceID, ctx.requestID, now)
+		if err != nil {
+			ctx.logf(logLevelError, "error_id_failed", err, "failed to generate an error id")
+		}
+	}
+	if ctx.override == requestOverrideDebug && ctx.requestOverride.allowDebug {
+		response.Debug = &problemDebug{
+			Rule:                ctx.matchedRule,
+			ResponseFlags:       ctx.getResponseFlags(),
+			UpstreamCluster:     ctx.getStringProperty("xds", "cluster_name"),
+			OriginalContentType: ctx.originalContentType,
+			OriginalBodyBytes:   len(originalBody),
+			TransformDurationUs: nowFunc().Sub(start).Microseconds(),
+		}
+	}
+
+	var b []byte
+	if ctx.renderHTML {
+		b = RenderHTMLErrorPage(ctx.templates[ctx.htmlTemplate], response)
+	} else {
+		b, err = json.Marshal(response)
+		if err != nil {
+			ctx.logf(logLevelError, "render_failed", err, "failed to marshal response struct to JSON")
+			ctx.countFailure(failureStageRender)
+			ctx.setTraceIDHeader()
+			return types.ActionContinue
+		}
+	}
+
+	if ctx.mode == modeShadow {
+		ctx.countMetric(metricShadowRewritten)
+		if ctx.logger.enabled(logLevelInfo) {
+			record := ctx.newLogRecord("shadow_rewrite", nil)
+			record.Message = "Response would have been transformed to rfc9457 format"
+			record.Problem = string(b)
+			ctx.logger.log(logLevelInfo, record)
+		}
+		return types.ActionContinue
+	}
+
+	if ctx.problemTypeLinkHeader && problemTypeURI != "" {
+		// Any upstream link headers are kept, there can be more than one
+		ctx.pendingResponseHeaders = append(ctx.pendingResponseHeaders, [2]string{"link", fmt.Sprintf("<%s>; rel=\"describedby\"", problemTypeURI)})
+	}
+	ctx.setContentLength(len(b))
+	if !ctx.commitResponse(originalBody, b) {
+		ctx.countFailure(failureStageCommit)
+		ctx.setTraceIDHeader()
 		return types.ActionContinue
 	}
-	proxywasm.LogInfof("Successfully transformed the response to rfc9457 format")
-	proxywasm.LogInfof("END OnHttpResponseBody")
+	ctx.rewritten = true
+	ctx.setFilterState()
+	ctx.countMetric(metricRewritten)
+	duration := nowFunc().Sub(start).Microseconds()
+	if ctx.metrics != nil {
+		ctx.metrics.outputBodyBytes.Record(uint64(len(b)))
+		ctx.metrics.transformDurationUs.Record(uint64(duration))
+	}
+	if ctx.logger.enabled(logLevelInfo) {
+		record := ctx.newLogRecord("response_rewritten", nil)
+		record.Message = "Successfully transformed the response to rfc9457 format"
+		record.DurationUs = duration
+		ctx.logger.log(logLevelInfo, record)
+	}
 
 	return types.ActionContinue
 }
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 )
@@ -31,9 +39,10 @@ func TestOnHttpResponseHeaders(t *testing.T) {
 			action := host.CallOnRequestHeaders(id, hs, false)
 
 			// Call OnHttpResponseHeaders.and set the status code to 503 an error response
+			// the headers are paused until the new body has been built
 			hs = [][2]string{{":status", "503"}, {"key2", "value2"}}
 			action = host.CallOnResponseHeaders(id, hs, false)
-			require.Equal(t, types.ActionContinue, action)
+			require.Equal(t, types.ActionPause, action)
 
 			// Call OnHttpStreamDone.
 			host.CompleteHttpContext(id)
@@ -45,7 +54,7 @@ func TestOnHttpResponseHeaders(t *testing.T) {
 
 			// Check Envoy logs.
 			logs := host.GetInfoLogs()
-			require.Contains(t, logs, "Response eligible for modification to rfc9457 format")
+			requireLogRecord(t, logs, logRecord{Event: "response_eligible", Message: "Response eligible for modification to rfc9457 format"})
 		})
 	})
 }
@@ -143,10 +152,2072 @@ func TestOnHttpResponseBody(t *testing.T) {
 
 				// Check Envoy logs.
 				logs := host.GetInfoLogs()
-				require.Contains(t, logs, "Successfully transformed the response to rfc9457 format")
+				requireLogRecord(t, logs, logRecord{Event: "response_rewritten", Message: "Successfully transformed the response to rfc9457 format"})
+			})
+		}
+
+	})
+}
+
+func TestHTMLErrorPages(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "htmlErrorPages": true}`)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		t.Run("browsers get an escaped html page", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/<script>alert(1)</script>"},
+				{"accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}}
+			host.CallOnRequestHeaders(id, hs, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "502"}}, false)
+			host.CallOnResponseBody(id, []byte(`<img src=x onerror="alert(1)">`), true)
+			host.CompleteHttpContext(id)
+
+			resHeaders := host.GetCurrentResponseHeaders(id)
+			require.Contains(t, resHeaders, [2]string{"content-type", "text/html; charset=utf-8"})
+			resBody := string(host.GetCurrentResponseBody(id))
+			require.True(t, strings.HasPrefix(resBody, "<!DOCTYPE html>"))
+			require.Contains(t, resBody, "<h1>502 service mesh returned an error</h1>")
+			require.Contains(t, resBody, "/&lt;script&gt;alert(1)&lt;/script&gt;")
+			require.Contains(t, resBody, "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;")
+			require.NotContains(t, resBody, "<script>")
+			require.NotContains(t, resBody, "<img")
+		})
+
+		t.Run("api clients still get problem+json", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"accept", "*/*"}}
+			host.CallOnRequestHeaders(id, hs, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "502"}}, false)
+			host.CallOnResponseBody(id, []byte("bad gateway"), true)
+			host.CompleteHttpContext(id)
+
+			require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"content-type", "application/problem+json"})
+			require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"vary", "Accept"})
+			var resp customErrorResponse
+			require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+			require.Equal(t, "bad gateway", resp.Detail)
+		})
+
+		t.Run("vary is merged with the upstream header", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"accept", "text/html"}}
+			host.CallOnRequestHeaders(id, hs, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "502"}, {"vary", "Accept-Encoding"}}, false)
+			host.CallOnResponseBody(id, []byte("bad gateway"), true)
+			host.CompleteHttpContext(id)
+
+			require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"vary", "Accept-Encoding, Accept"})
+		})
+	})
+
+	t.Run("AddVary", func(t *testing.T) {
+		require.Equal(t, "Accept", AddVary("", "Accept"))
+		require.Equal(t, "Origin, Accept", AddVary("Origin", "Accept"))
+		require.Equal(t, "origin, accept", AddVary("origin, accept", "Accept"))
+		require.Equal(t, "*", AddVary("*", "Accept"))
+	})
+}
+
+func TestPrefersHTML(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                 false,
+		"*/*":              false,
+		"application/json": false,
+		"text/html":        true,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": true,
+		"application/json, text/html;q=0.5":                               false,
+		"text/html;q=0, */*":                                              false,
+	} {
+		require.Equal(t, expected, PrefersHTML(accept), accept)
+	}
+}
+
+func TestProblemTitles(t *testing.T) {
+	type testCase struct {
+		statusCode     string
+		acceptLanguage string
+		expectedTitle  string
+	}
+
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"problemTitle": "something went wrong",
+		"problemTitles": {"503": "Try again later", "https://datatracker.ietf.org/html/rfc9110#section-15.6.5": "Upstream too slow"},
+		"localizedProblemTitles": {"de": {"404": "Nicht gefunden"}, "fr-CA": {"404": "Introuvable"}}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"reason phrase default":        {statusCode: "401", expectedTitle: "Unauthorized"},
+			"configured status title":      {statusCode: "503", expectedTitle: "Try again later"},
+			"configured problem type":      {statusCode: "504", expectedTitle: "Upstream too slow"},
+			"unknown status code":          {statusCode: "499", expectedTitle: "something went wrong"},
+			"primary language fallback":    {statusCode: "404", acceptLanguage: "de-CH, en;q=0.5", expectedTitle: "Nicht gefunden"},
+			"language preference order":    {statusCode: "404", acceptLanguage: "de;q=0.4, fr-ca", expectedTitle: "Introuvable"},
+			"no localized title available": {statusCode: "503", acceptLanguage: "de", expectedTitle: "Try again later"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"accept-language", tCase.acceptLanguage}}
+				host.CallOnRequestHeaders(id, hs, false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", tCase.statusCode}}, false)
+				host.CallOnResponseBody(id, []byte("error"), true)
+				host.CompleteHttpContext(id)
+
+				var resp customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+				require.Equal(t, tCase.expectedTitle, resp.Title)
+			})
+		}
+	})
+}
+
+func TestDetailTemplates(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		t.Run("variables are rendered", func(t *testing.T) {
+			config := `{
+				"targetURLPrefixes": ["my-host.com"],
+				"problemTitle": "{{authority}} returned {{status}}",
+				"detailTemplate": "Upstream {{upstream_cluster}} failed for {{method}} {{path}} ({{response_flags|-}}): {{body}}"
+			}`
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(config)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			require.NoError(t, host.SetProperty([]string{"xds", "cluster_name"}, []byte("outbound|8080||foo.default.svc.cluster.local")))
+			flags := make([]byte, 8)
+			binary.LittleEndian.PutUint64(flags, 0x80|0x2)
+			require.NoError(t, host.SetProperty([]string{"response", "flags"}, flags))
+
+			id := host.InitializeHttpContext()
+			hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/foo"}, {":method", "POST"}}
+			host.CallOnRequestHeaders(id, hs, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}}, false)
+			host.CallOnResponseBody(id, []byte("upstream connect error"), true)
+			host.CompleteHttpContext(id)
+
+			var resp customErrorResponse
+			require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+			require.Equal(t, "my-host.com returned 503", resp.Title)
+			require.Equal(t, "Upstream outbound|8080||foo.default.svc.cluster.local failed for POST /foo (UH,UO): upstream connect error", resp.Detail)
+		})
+
+		for name, config := range map[string]string{
+			"unknown variable":      `{"targetURLPrefixes": ["my-host.com"], "detailTemplate": "{{upstream_clustr}}"}`,
+			"unterminated variable": `{"targetURLPrefixes": ["my-host.com"], "problemTitles": {"503": "{{status"}}`,
+			"unknown html variable": `{"targetURLPrefixes": ["my-host.com"], "htmlTemplate": "<p>{{body}}</p>"}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+			})
+		}
+	})
+}
+
+func TestStatusRemaps(t *testing.T) {
+	type testCase struct {
+		statusCode       string
+		responseFlags    uint64
+		path             string
+		expectedStatus   int
+		expectedOriginal int
+	}
+
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"statusRemaps": [
+			{"name": "overflow", "from": 503, "to": 429, "responseFlags": ["UO"]},
+			{"name": "legacy-gateway", "from": 502, "to": 503, "targetURLPrefixes": ["my-host.com/legacy"]}
+		]
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"overflow presented as 429":   {statusCode: "503", responseFlags: 0x80, path: "/", expectedStatus: 429, expectedOriginal: 503},
+			"503 without overflow":        {statusCode: "503", responseFlags: 0x2, path: "/", expectedStatus: 503},
+			"502 on a matching prefix":    {statusCode: "502", path: "/legacy/foo", expectedStatus: 503, expectedOriginal: 502},
+			"502 on another prefix":       {statusCode: "502", path: "/foo", expectedStatus: 502},
+			"status without a remap rule": {statusCode: "500", path: "/legacy", expectedStatus: 500},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				flags := make([]byte, 8)
+				binary.LittleEndian.PutUint64(flags, tCase.responseFlags)
+				require.NoError(t, host.SetProperty([]string{"response", "flags"}, flags))
+
+				id := host.InitializeHttpContext()
+				hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", tCase.path}}
+				host.CallOnRequestHeaders(id, hs, false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", tCase.statusCode}}, false)
+				host.CallOnResponseBody(id, []byte("error"), true)
+				host.CompleteHttpContext(id)
+
+				require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{":status", strconv.Itoa(tCase.expectedStatus)})
+				var resp customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+				require.Equal(t, tCase.expectedStatus, resp.Status)
+				require.Equal(t, tCase.expectedOriginal, resp.OriginalStatus)
+			})
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	type testCase struct {
+		statusCode         string
+		responseHeaders    [][2]string
+		expectedRetryAfter string
+		expectedSeconds    int
+		expectedRemaining  string
+	}
+
+	config := `{"targetURLPrefixes": ["my-host.com"], "retryAfter": {"statusCodes": [429, 503], "seconds": 30}}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"fixed value for envoy rate limiting": {
+				statusCode:         "429",
+				responseHeaders:    [][2]string{{"x-envoy-ratelimited", "true"}},
+				expectedRetryAfter: "30",
+				expectedSeconds:    30,
+			},
+			"derived from x-ratelimit-reset": {
+				statusCode:         "429",
+				responseHeaders:    [][2]string{{"x-ratelimit-limit", "100"}, {"x-ratelimit-remaining", "0"}, {"x-ratelimit-reset", "7"}},
+				expectedRetryAfter: "7",
+				expectedSeconds:    7,
+				expectedRemaining:  "0",
+			},
+			"upstream retry-after is kept": {
+				statusCode:         "503",
+				responseHeaders:    [][2]string{{"retry-after", "120"}},
+				expectedRetryAfter: "120",
+				expectedSeconds:    120,
+			},
+			"status not configured": {
+				statusCode:      "500",
+				responseHeaders: [][2]string{{"x-ratelimit-reset", "7"}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}
+				host.CallOnRequestHeaders(id, hs, false)
+				host.CallOnResponseHeaders(id, append([][2]string{{":status", tCase.statusCode}}, tCase.responseHeaders...), false)
+				host.CallOnResponseBody(id, []byte("error"), true)
+				host.CompleteHttpContext(id)
+
+				resHeaders := host.GetCurrentResponseHeaders(id)
+				if tCase.expectedRetryAfter == "" {
+					for _, header := range resHeaders {
+						require.NotEqual(t, "retry-after", header[0])
+					}
+				} else {
+					require.Contains(t, resHeaders, [2]string{"retry-after", tCase.expectedRetryAfter})
+				}
+				var resp customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+				require.Equal(t, tCase.expectedSeconds, resp.RetryAfterSeconds)
+				require.Equal(t, tCase.expectedRemaining, resp.RateLimitRemaining)
 			})
 		}
+	})
+}
+
+func TestResponseHeaderPolicy(t *testing.T) {
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"responseHeaderPolicy": {
+			"deny": ["server", "x-envoy-upstream-service-time", "x-debug-*"],
+			"cacheControlNoStore": true,
+			"preserveCORS": true
+		}
+	}`
+	responseHeaders := [][2]string{
+		{"server", "envoy"}, {"x-envoy-upstream-service-time", "12"}, {"x-debug-pod", "foo-123"},
+		{"access-control-allow-origin", "*"}, {"cache-control", "max-age=60"}, {"x-request-id", "abc"},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(config)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		t.Run("rewritten errors are cleaned up", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+			host.CallOnResponseHeaders(id, append([][2]string{{":status", "500"}}, responseHeaders...), false)
+			host.CallOnResponseBody(id, []byte("error"), true)
+			host.CompleteHttpContext(id)
+
+			resHeaders := host.GetCurrentResponseHeaders(id)
+			require.ElementsMatch(t, [][2]string{
+				{":status", "500"}, {"access-control-allow-origin", "*"}, {"cache-control", "no-store"},
+				{"x-request-id", "abc"}, {"content-type", "application/problem+json"},
+			}, resHeaders)
+		})
+
+		t.Run("other responses are untouched", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "other-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+			host.CallOnResponseHeaders(id, append([][2]string{{":status", "500"}}, responseHeaders...), false)
+			host.CompleteHttpContext(id)
+
+			require.ElementsMatch(t, append([][2]string{{":status", "500"}}, responseHeaders...), host.GetCurrentResponseHeaders(id))
+		})
+	})
+}
+
+func TestHeadersToRemove(t *testing.T) {
+	headers := [][2]string{{":status", "503"}, {"Server", "envoy"}, {"content-type", "text/plain"}, {"x-trace", "1"}, {"access-control-allow-origin", "*"}}
+	policy := responseHeaderPolicy{allow: []string{"x-*"}}
+	require.Equal(t, []string{"server", "access-control-allow-origin"}, HeadersToRemove(headers, policy))
+	policy.preserveCORS = true
+	require.Equal(t, []string{"server"}, HeadersToRemove(headers, policy))
+}
+
+func TestContentLength(t *testing.T) {
+	type testCase struct {
+		protocol string
+		// true when the exact content-length should be set, otherwise it should be removed
+		expectContentLength bool
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"http/1.1 gets the exact size": {protocol: "HTTP/1.1", expectContentLength: true},
+			"http/2 has it removed":        {protocol: "HTTP/2", expectContentLength: false},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"]}`)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				require.NoError(t, host.SetProperty([]string{"request", "protocol"}, []byte(tCase.protocol)))
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+
+				// The headers are paused while the body is buffered
+				action := host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}, {"content-length", "11"}}, false)
+				require.Equal(t, types.ActionPause, action)
+				action = host.CallOnResponseBody(id, []byte("no "), false)
+				require.Equal(t, types.ActionPause, action)
+				// Once the whole body has been seen the stream is resumed with the new body
+				action = host.CallOnResponseBody(id, []byte("healthy"), true)
+				require.Equal(t, types.ActionContinue, action)
+				host.CompleteHttpContext(id)
+
+				resBody := host.GetCurrentResponseBody(id)
+				var resp customErrorResponse
+				require.NoError(t, json.Unmarshal(resBody, &resp))
+				require.Equal(t, "no healthy", resp.Detail)
+
+				resHeaders := host.GetCurrentResponseHeaders(id)
+				if tCase.expectContentLength {
+					require.Contains(t, resHeaders, [2]string{"content-length", strconv.Itoa(len(resBody))})
+				} else {
+					for _, header := range resHeaders {
+						require.NotEqual(t, "content-length", header[0])
+					}
+				}
+			})
+		}
+
+		t.Run("responses without a body are not paused", func(t *testing.T) {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"]}`)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+			action := host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}}, true)
+			require.Equal(t, types.ActionContinue, action)
+			require.Equal(t, [][2]string{{":status", "503"}}, host.GetCurrentResponseHeaders(id))
+		})
+	})
+}
+
+func TestResponseHeadersHeldUntilBodyIsBuilt(t *testing.T) {
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"statusRemaps": [{"from": 502, "to": 503}],
+		"responseHeaderPolicy": {"deny": ["server"]}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(config)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+
+		original := [][2]string{{":status", "502"}, {"content-type", "text/plain"}, {"server", "envoy"}}
+		action := host.CallOnResponseHeaders(id, original, false)
+		require.Equal(t, types.ActionPause, action)
+		// Nothing has been changed while the body is still being buffered
+		require.Equal(t, original, host.GetCurrentResponseHeaders(id))
+		action = host.CallOnResponseBody(id, []byte("bad"), false)
+		require.Equal(t, types.ActionPause, action)
+		require.Equal(t, original, host.GetCurrentResponseHeaders(id))
+
+		// The headers and the body are committed together
+		action = host.CallOnResponseBody(id, []byte(" gateway"), true)
+		require.Equal(t, types.ActionContinue, action)
+		require.Equal(t, [][2]string{{":status", "503"}, {"content-type", "application/problem+json"}}, host.GetCurrentResponseHeaders(id))
+		var resp customErrorResponse
+		require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+		require.Equal(t, 503, resp.Status)
+		require.Equal(t, "bad gateway", resp.Detail)
+	})
+}
+
+func TestCommitFailures(t *testing.T) {
+	defer func() {
+		replaceResponseBody = proxywasm.ReplaceHttpResponseBody
+		replaceResponseHeaders = proxywasm.ReplaceHttpResponseHeaders
+	}()
+
+	type testCase struct {
+		failBody    bool
+		failHeaders bool
+		expectedLog logRecord
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		if _, ok := vm.(*vmContext); !ok {
+			t.Skip("the host calls can only be replaced when the plugin runs in the host")
+		}
+		for name, tCase := range map[string]testCase{
+			"the body can't be replaced": {
+				failBody:    true,
+				expectedLog: logRecord{Event: "commit_failed", Message: "failed to replace response body"},
+			},
+			"the headers can't be replaced so the original body is restored": {
+				failHeaders: true,
+				expectedLog: logRecord{Event: "commit_failed", Message: "failed to replace response headers, restoring the original body"},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				replaceResponseBody = func(body []byte) error {
+					if tCase.failBody {
+						return types.ErrorStatusBadArgument
+					}
+					return proxywasm.ReplaceHttpResponseBody(body)
+				}
+				replaceResponseHeaders = func(headers [][2]string) error {
+					if tCase.failHeaders {
+						return types.ErrorStatusBadArgument
+					}
+					return proxywasm.ReplaceHttpResponseHeaders(headers)
+				}
+
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "statusRemaps": [{"from": 502, "to": 503}], "traceIDHeader": {"allResponses": true}}`)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+				original := [][2]string{{":status", "502"}, {"content-type", "text/plain"}}
+				host.CallOnResponseHeaders(id, original, false)
+				action := host.CallOnResponseBody(id, []byte("bad gateway"), true)
+				require.Equal(t, types.ActionContinue, action)
+				host.CompleteHttpContext(id)
+
+				// The client gets the upstream response with only the trace id header added
+				require.Equal(t, append(original, [2]string{"x-trace-id", defaultTraceID}), host.GetCurrentResponseHeaders(id))
+				require.Equal(t, "bad gateway", string(host.GetCurrentResponseBody(id)))
+				requireLogRecord(t, host.GetErrorLogs(), tCase.expectedLog)
+				value, err := host.GetCounterMetric("problem_details.failures")
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), value)
+				value, err = host.GetCounterMetric("problem_details.rewritten")
+				require.NoError(t, err)
+				require.Equal(t, uint64(0), value)
+			})
+		}
+	})
+}
+
+func TestHeaderHelpers(t *testing.T) {
+	headers := [][2]string{{":status", "502"}, {"x-a", "1"}, {"x-b", "2"}, {"x-a", "3"}}
+	headers = setHeader(cloneHeaders(headers), ":status", "503")
+	headers = setHeader(headers, "x-a", "4")
+	headers = setHeader(headers, "x-c", "5")
+	require.Equal(t, [][2]string{{":status", "503"}, {"x-a", "4"}, {"x-b", "2"}, {"x-c", "5"}}, headers)
+	require.Equal(t, "2", getHeader(headers, "X-B"))
+	require.Equal(t, [][2]string{{":status", "503"}, {"x-b", "2"}, {"x-c", "5"}}, removeHeader(headers, "x-a"))
+}
+
+func TestTraceIDHeader(t *testing.T) {
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"traceIDHeader": {"name": "X-Correlation-ID", "allResponses": true},
+		"problemTypeLinkHeader": true,
+		"responseHeaderPolicy": {"allow": ["x-request-id"]}
+	}`
+	traceID := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(config)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		t.Run("rewritten errors", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"traceparent", traceID}}, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "404"}}, false)
+			host.CallOnResponseBody(id, []byte("not found"), true)
+			host.CompleteHttpContext(id)
+
+			resHeaders := host.GetCurrentResponseHeaders(id)
+			require.Contains(t, resHeaders, [2]string{"x-correlation-id", traceID})
+			require.Contains(t, resHeaders, [2]string{"link", `<https://datatracker.ietf.org/html/rfc9110#section-15.5.5>; rel="describedby"`})
+		})
+
+		t.Run("other responses", func(t *testing.T) {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"traceparent", traceID}}, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, false)
+			host.CompleteHttpContext(id)
 
+			require.Equal(t, [][2]string{{":status", "200"}, {"x-correlation-id", traceID}}, host.GetCurrentResponseHeaders(id))
+		})
+	})
+
+	t.Run("link header without the trace id header", func(t *testing.T) {
+		vmTest(t, func(t *testing.T, vm types.VMContext) {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "problemTypeLinkHeader": true}`)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"traceparent", traceID}}, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "404"}}, false)
+			host.CallOnResponseBody(id, []byte("not found"), true)
+			host.CompleteHttpContext(id)
+
+			resHeaders := host.GetCurrentResponseHeaders(id)
+			require.Contains(t, resHeaders, [2]string{"link", `<https://datatracker.ietf.org/html/rfc9110#section-15.5.5>; rel="describedby"`})
+			for _, header := range resHeaders {
+				require.NotEqual(t, defaultTraceIDHeader, header[0])
+			}
+		})
+	})
+}
+
+func TestErrorIDAndTimestamp(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	randomRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = byte(i)
+		}
+		return len(b), nil
+	}
+	defer func() {
+		nowFunc = time.Now
+		randomRead = rand.Read
+	}()
+
+	traceID := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	requestID := "a7b6c5d4-0000-4000-8000-000000000001"
+	// The trace mode id is derived from the trace id, the x-request-id and the time of the error
+	sum := sha256.Sum256([]byte(traceID + "|" + requestID + "|2024-03-01T12:30:00Z"))
+	expectedTraceErrorID := hex.EncodeToString(sum[:16])
+
+	type testCase struct {
+		config          string
+		requestHeaders  [][2]string
+		expectedErrorID string
+		expectedTime    string
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		if _, ok := vm.(*vmContext); !ok {
+			t.Skip("the clock and random source can only be replaced when the plugin runs in the host")
+		}
+		for name, tCase := range map[string]testCase{
+			"random error id and timestamp": {
+				config:          `{"targetURLPrefixes": ["my-host.com"], "errorID": "random", "timestamp": true}`,
+				expectedErrorID: "000102030405060708090a0b0c0d0e0f",
+				expectedTime:    "2024-03-01T12:30:00Z",
+			},
+			"error id derived from the trace id": {
+				config:          `{"targetURLPrefixes": ["my-host.com"], "errorID": "trace"}`,
+				requestHeaders:  [][2]string{{"traceparent", traceID}, {"x-request-id", requestID}},
+				expectedErrorID: expectedTraceErrorID,
+			},
+			"requests without a trace id get a random error id": {
+				config:          `{"targetURLPrefixes": ["my-host.com"], "errorID": "trace"}`,
+				expectedErrorID: "000102030405060708090a0b0c0d0e0f",
+			},
+			"disabled": {
+				config: `{"targetURLPrefixes": ["my-host.com"]}`,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(tCase.config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, append([][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, tCase.requestHeaders...), false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}}, false)
+				host.CallOnResponseBody(id, []byte("error"), true)
+				host.CompleteHttpContext(id)
+
+				var resp customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &resp))
+				require.Equal(t, tCase.expectedErrorID, resp.ErrorID)
+				require.Equal(t, tCase.expectedTime, resp.Timestamp)
+			})
+		}
+	})
+}
+
+func TestNewErrorID(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	traceID := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	t.Run("requests without a trace id get different ids", func(t *testing.T) {
+		first, err := NewErrorID(errorIDModeTrace, defaultTraceID, "", now)
+		require.NoError(t, err)
+		second, err := NewErrorID(errorIDModeTrace, defaultTraceID, "", now.Add(300*time.Millisecond))
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("retries of a traceparent get different ids", func(t *testing.T) {
+		first, err := NewErrorID(errorIDModeTrace, traceID, "request-1", now)
+		require.NoError(t, err)
+		second, err := NewErrorID(errorIDModeTrace, traceID, "request-2", now)
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+		// without an x-request-id the sub second time still tells them apart
+		first, err = NewErrorID(errorIDModeTrace, traceID, "", now)
+		require.NoError(t, err)
+		second, err = NewErrorID(errorIDModeTrace, traceID, "", now.Add(300*time.Millisecond))
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		first, err := NewErrorID(errorIDModeTrace, traceID, "request-1", now)
+		require.NoError(t, err)
+		second, err := NewErrorID(errorIDModeTrace, traceID, "request-1", now)
+		require.NoError(t, err)
+		require.Equal(t, first, second)
+		require.Len(t, first, 32)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"]}`)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		call := func(authority string, responseHeaders [][2]string, body string) uint32 {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", authority}, {":scheme", "https"}, {":path", "/"}}, false)
+			host.CallOnResponseHeaders(id, responseHeaders, false)
+			host.CallOnResponseBody(id, []byte(body), true)
+			host.CompleteHttpContext(id)
+			return id
+		}
+		call("my-host.com", [][2]string{{":status", "503"}}, "error")
+		call("my-host.com", [][2]string{{":status", "404"}, {"content-type", "application/problem+json"}}, "error")
+		// Media type parameters don't stop a problem document being passed through
+		problem := `{"type":"about:blank","status":404}`
+		id := call("my-host.com", [][2]string{{":status", "404"}, {"content-type", "application/problem+json; charset=utf-8"}}, problem)
+		require.Equal(t, problem, string(host.GetCurrentResponseBody(id)))
+		call("other-host.com", [][2]string{{":status", "500"}}, "error")
+		call("my-host.com", [][2]string{{":status", "200"}}, "error")
+
+		for name, expected := range map[string]uint64{
+			"problem_details.errors_seen":    4,
+			"problem_details.rewritten":      1,
+			"problem_details.passed_through": 2,
+			"problem_details.skipped":        1,
+			"problem_details.failures":       0,
+			"problem_details.rewritten.status_class.5xx.problem_type.datatracker_ietf_org_html_rfc9110_section-15_6_4.rule.default":      1,
+			"problem_details.passed_through.status_class.4xx.problem_type.datatracker_ietf_org_html_rfc9110_section-15_5_5.rule.default": 2,
+			"problem_details.skipped.status_class.5xx.problem_type.datatracker_ietf_org_html_rfc9110_section-15_6_1.rule.none":           1,
+		} {
+			value, err := host.GetCounterMetric(name)
+			require.NoError(t, err, name)
+			require.Equal(t, expected, value, name)
+		}
+	})
+}
+
+func TestHistogramMetrics(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	calls := 0
+	nowFunc = func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls*250) * time.Microsecond)
+	}
+	defer func() { nowFunc = time.Now }()
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		if _, ok := vm.(*vmContext); !ok {
+			t.Skip("the clock can only be replaced when the plugin runs in the host")
+		}
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"]}`)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+		host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}}, false)
+		host.CallOnResponseBody(id, []byte("no healthy upstream"), true)
+		host.CompleteHttpContext(id)
+
+		originalSize, err := host.GetHistogramMetric("problem_details.original_body_bytes")
+		require.NoError(t, err)
+		require.Equal(t, uint64(len("no healthy upstream")), originalSize)
+		outputSize, err := host.GetHistogramMetric("problem_details.output_body_bytes")
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(host.GetCurrentResponseBody(id))), outputSize)
+		duration, err := host.GetHistogramMetric("problem_details.transform_duration_us")
+		require.NoError(t, err)
+		// The clock moves on by 250us every time it is read
+		require.NotZero(t, duration)
+		require.Zero(t, duration%250)
+	})
+}
+
+func TestFilterState(t *testing.T) {
+	type testCase struct {
+		authority         string
+		responseHeaders   [][2]string
+		expectedType      string
+		expectedRule      string
+		expectedOriginal  string
+		expectedRewritten string
+	}
+
+	config := `{"targetURLPrefixes": ["my-host.com"], "statusRemaps": [{"from": 502, "to": 503}]}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"rewritten and remapped": {
+				authority:         "my-host.com",
+				responseHeaders:   [][2]string{{":status", "502"}},
+				expectedType:      "https://datatracker.ietf.org/html/rfc9110#section-15.6.4",
+				expectedRule:      "default",
+				expectedOriginal:  "502",
+				expectedRewritten: "true",
+			},
+			"already problem+json": {
+				authority:         "my-host.com",
+				responseHeaders:   [][2]string{{":status", "404"}, {"content-type", "application/problem+json"}},
+				expectedType:      "https://datatracker.ietf.org/html/rfc9110#section-15.5.5",
+				expectedRule:      "default",
+				expectedOriginal:  "404",
+				expectedRewritten: "false",
+			},
+			"no matching rule": {
+				authority:         "other-host.com",
+				responseHeaders:   [][2]string{{":status", "500"}},
+				expectedType:      "https://datatracker.ietf.org/html/rfc9110#section-15.6.1",
+				expectedRule:      "none",
+				expectedOriginal:  "500",
+				expectedRewritten: "false",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", tCase.authority}, {":scheme", "https"}, {":path", "/"}}, false)
+				host.CallOnResponseHeaders(id, tCase.responseHeaders, false)
+				host.CallOnResponseBody(id, []byte("error"), true)
+				host.CompleteHttpContext(id)
+
+				for key, expected := range map[string]string{
+					"problem_details.type":            tCase.expectedType,
+					"problem_details.rule":            tCase.expectedRule,
+					"problem_details.original_status": tCase.expectedOriginal,
+					"problem_details.rewritten":       tCase.expectedRewritten,
+				} {
+					value, err := host.GetProperty([]string{key})
+					require.NoError(t, err, key)
+					require.Equal(t, expected, string(value), key)
+				}
+			})
+		}
+	})
+}
+
+func TestStructuredLogging(t *testing.T) {
+	type testCase struct {
+		config            string
+		requests          int
+		expectedDebugLogs int
+		expectedRewritten int
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"info by default": {
+				config:            `{"targetURLPrefixes": ["my-host.com"]}`,
+				requests:          3,
+				expectedDebugLogs: 0,
+				expectedRewritten: 3,
+			},
+			"debug level": {
+				config:            `{"targetURLPrefixes": ["my-host.com"], "logLevel": "debug"}`,
+				requests:          1,
+				expectedDebugLogs: 2,
+				expectedRewritten: 1,
+			},
+			"sampled events": {
+				config:            `{"targetURLPrefixes": ["my-host.com"], "logSampling": {"response_rewritten": 2}}`,
+				requests:          5,
+				expectedRewritten: 3,
+			},
+			"error level": {
+				config:   `{"targetURLPrefixes": ["my-host.com"], "logLevel": "error"}`,
+				requests: 2,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(tCase.config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				for i := 0; i < tCase.requests; i++ {
+					id := host.InitializeHttpContext()
+					hs := [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {":method", "GET"}, {"x-request-id", "abc"}}
+					host.CallOnRequestHeaders(id, hs, false)
+					host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}}, false)
+					host.CallOnResponseBody(id, []byte("error"), true)
+					host.CompleteHttpContext(id)
+				}
+
+				require.Len(t, host.GetDebugLogs(), tCase.expectedDebugLogs)
+				rewritten := 0
+				for _, line := range host.GetInfoLogs() {
+					var record logRecord
+					require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+					if record.Event == "response_rewritten" {
+						require.Equal(t, "abc", record.TraceID)
+						require.Equal(t, 503, record.Status)
+						require.Equal(t, "default", record.Rule)
+						rewritten++
+					}
+				}
+				require.Equal(t, tCase.expectedRewritten, rewritten)
+			})
+		}
+
+		t.Run("invalid log level", func(t *testing.T) {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "logLevel": "verbose"}`)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+			requireLogRecord(t, host.GetCriticalLogs(), logRecord{Event: "plugin_config_invalid", Message: "error parsing plugin configuration"})
+		})
+
+		t.Run("empty configuration logs at info", func(t *testing.T) {
+			opt := proxytest.NewEmulatorOption().WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}}, false)
+			host.CompleteHttpContext(id)
+			require.Empty(t, host.GetDebugLogs())
+			require.Empty(t, host.GetTraceLogs())
+		})
+	})
+}
+
+// requireLogRecord checks that one of the JSON log lines has the event and message of the expected record
+func requireLogRecord(t *testing.T, logs []string, expected logRecord) {
+	t.Helper()
+	for _, line := range logs {
+		var record logRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			continue
+		}
+		if record.Event == expected.Event && record.Message == expected.Message {
+			return
+		}
+	}
+	require.Failf(t, "log record not found", "event %q with message %q not in %v", expected.Event, expected.Message, logs)
+}
+
+func TestShadowMode(t *testing.T) {
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"mode": "shadow",
+		"statusRemaps": [{"from": 502, "to": 503}],
+		"traceIDHeader": {"allResponses": true}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(config)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}, {"x-request-id", "abc"}}, false)
+
+		original := [][2]string{{":status", "502"}, {"content-type", "text/plain"}}
+		require.Equal(t, types.ActionContinue, host.CallOnResponseHeaders(id, original, false))
+		require.Equal(t, types.ActionContinue, host.CallOnResponseBody(id, []byte("bad "), false))
+		require.Equal(t, types.ActionContinue, host.CallOnResponseBody(id, []byte("gateway"), true))
+		host.CompleteHttpContext(id)
+
+		// The response is untouched
+		require.Equal(t, original, host.GetCurrentResponseHeaders(id))
+		require.Equal(t, "gateway", string(host.GetCurrentResponseBody(id)))
+
+		// But the would-be problem document is logged and counted
+		var problem customErrorResponse
+		for _, line := range host.GetInfoLogs() {
+			var record logRecord
+			require.NoError(t, json.Unmarshal([]byte(line), &record))
+			if record.Event == "shadow_rewrite" {
+				require.NoError(t, json.Unmarshal([]byte(record.Problem), &problem))
+			}
+		}
+		require.Equal(t, 503, problem.Status)
+		require.Equal(t, 502, problem.OriginalStatus)
+		require.Equal(t, "bad gateway", problem.Detail)
+
+		shadowRewritten, err := host.GetCounterMetric("problem_details.shadow_rewritten")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), shadowRewritten)
+		rewritten, err := host.GetCounterMetric("problem_details.rewritten")
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), rewritten)
+
+		// The filter state describes the response the client got, not the remapped one
+		for key, expected := range map[string]string{
+			"problem_details.type":            "https://datatracker.ietf.org/html/rfc9110#section-15.6.3",
+			"problem_details.original_status": "502",
+			"problem_details.rewritten":       "false",
+		} {
+			value, err := host.GetProperty([]string{key})
+			require.NoError(t, err, key)
+			require.Equal(t, expected, string(value), key)
+		}
+	})
+}
+
+func TestRollout(t *testing.T) {
+	type testCase struct {
+		authority      string
+		requestHeaders [][2]string
+		expectedRule   string
+		expectedAction types.Action
+	}
+
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"rules": [
+			{"name": "canary", "targetURLPrefixes": ["canary.my-host.com"], "rollout": {"percentage": 0}},
+			{"name": "by-user", "targetURLPrefixes": ["users.my-host.com"], "rollout": {"percentage": 50, "hashHeader": "x-user-id"}},
+			{"name": "by-trace", "targetURLPrefixes": ["traces.my-host.com"], "rollout": {"percentage": 50}}
+		]
+	}`
+
+	// Find a user in and out of the 50% rollout so that the test doesn't depend on the hash values
+	var userIn, userOut string
+	for i := 0; userIn == "" || userOut == ""; i++ {
+		user := "user-" + strconv.Itoa(i)
+		if InRollout(user, 50) {
+			userIn = user
+		} else {
+			userOut = user
+		}
+	}
+	var requestIn string
+	for i := 0; requestIn == ""; i++ {
+		if id := "request-" + strconv.Itoa(i); InRollout(id, 50) {
+			requestIn = id
+		}
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"default rule": {
+				authority:      "my-host.com",
+				expectedRule:   "default",
+				expectedAction: types.ActionPause,
+			},
+			"rule with no rollout": {
+				authority:      "canary.my-host.com",
+				expectedRule:   "canary",
+				expectedAction: types.ActionContinue,
+			},
+			"hash header in rollout": {
+				authority:      "users.my-host.com",
+				requestHeaders: [][2]string{{"x-user-id", userIn}},
+				expectedRule:   "by-user",
+				expectedAction: types.ActionPause,
+			},
+			"hash header out of rollout": {
+				authority:      "users.my-host.com",
+				requestHeaders: [][2]string{{"x-user-id", userOut}},
+				expectedRule:   "by-user",
+				expectedAction: types.ActionContinue,
+			},
+			"trace id in rollout": {
+				authority:      "traces.my-host.com",
+				requestHeaders: [][2]string{{"x-request-id", requestIn}},
+				expectedRule:   "by-trace",
+				expectedAction: types.ActionPause,
+			},
+			// The default trace id would put every untraced request in the same bucket
+			"untraced requests are skipped": {
+				authority:      "traces.my-host.com",
+				expectedRule:   "by-trace",
+				expectedAction: types.ActionContinue,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				hs := append([][2]string{{":authority", tCase.authority}, {":scheme", "https"}, {":path", "/"}}, tCase.requestHeaders...)
+				host.CallOnRequestHeaders(id, hs, false)
+				action := host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}}, false)
+				require.Equal(t, tCase.expectedAction, action)
+
+				rule, err := host.GetProperty([]string{"problem_details.rule"})
+				require.NoError(t, err)
+				require.Equal(t, tCase.expectedRule, string(rule))
+			})
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		require.False(t, InRollout("abc", 0))
+		require.True(t, InRollout("abc", 100))
+		require.Equal(t, InRollout("abc", 50), InRollout("abc", 50))
+
+		inRollout := 0
+		for i := 0; i < 10000; i++ {
+			if InRollout("request-"+strconv.Itoa(i), 25) {
+				inRollout++
+			}
+		}
+		require.InDelta(t, 2500, inRollout, 250)
+	})
+
+	t.Run("retries of a traceparent share a key", func(t *testing.T) {
+		first := RolloutKey("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		retry := RolloutKey("00-0af7651916cd43dd8448eb211c80319c-00f067aa0ba902b7-01")
+		require.Equal(t, first, retry)
+		require.Equal(t, "abc", RolloutKey("abc"))
+	})
+
+	t.Run("invalid percentage", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "rollout": {"percentage": 101}}`))
+		require.Error(t, err)
+		_, err = parsePluginConfiguration([]byte(`{"rules": [{"name": "a"}]}`))
+		require.Error(t, err)
+	})
+}
+
+func TestRequestOverride(t *testing.T) {
+	type testCase struct {
+		config         string
+		authority      string
+		requestHeaders [][2]string
+		expectedAction types.Action
+		expectedRule   string
+	}
+
+	config := `{"targetURLPrefixes": ["my-host.com"], "requestOverride": {}}`
+	secretConfig := `{"targetURLPrefixes": ["my-host.com"], "requestOverride": {"header": "x-errors", "secret": "s3cret"}}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"no override": {
+				config:         config,
+				authority:      "my-host.com",
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+			},
+			"off": {
+				config:         config,
+				authority:      "my-host.com",
+				requestHeaders: [][2]string{{"x-problem-details", "off"}},
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"on without a matching rule": {
+				config:         config,
+				authority:      "other-host.com",
+				requestHeaders: [][2]string{{"x-problem-details", "on"}},
+				expectedAction: types.ActionPause,
+				expectedRule:   "request_override",
+			},
+			"unknown value": {
+				config:         config,
+				authority:      "my-host.com",
+				requestHeaders: [][2]string{{"x-problem-details", "maybe"}},
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+			},
+			"off with the secret": {
+				config:         secretConfig,
+				authority:      "my-host.com",
+				requestHeaders: [][2]string{{"x-errors", "off"}, {"x-problem-details-secret", "s3cret"}},
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"off with the wrong secret": {
+				config:         secretConfig,
+				authority:      "my-host.com",
+				requestHeaders: [][2]string{{"x-errors", "off"}, {"x-problem-details-secret", "guess"}},
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+			},
+			"on without the secret": {
+				config:         secretConfig,
+				authority:      "other-host.com",
+				requestHeaders: [][2]string{{"x-errors", "on"}},
+				expectedAction: types.ActionContinue,
+				expectedRule:   "none",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(tCase.config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				hs := append([][2]string{{":authority", tCase.authority}, {":scheme", "https"}, {":path", "/"}}, tCase.requestHeaders...)
+				host.CallOnRequestHeaders(id, hs, false)
+				action := host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}}, false)
+				require.Equal(t, tCase.expectedAction, action)
+
+				rule, err := host.GetProperty([]string{"problem_details.rule"})
+				require.NoError(t, err)
+				require.Equal(t, tCase.expectedRule, string(rule))
+
+				// The secret is never sent upstream
+				for _, header := range host.GetCurrentRequestHeaders(id) {
+					require.NotEqual(t, "x-problem-details-secret", header[0])
+				}
+			})
+		}
+	})
+}
+
+func TestDebugExtension(t *testing.T) {
+	type testCase struct {
+		config         string
+		requestHeaders [][2]string
+		expectDebug    bool
+	}
+
+	config := `{"targetURLPrefixes": ["my-host.com"], "requestOverride": {"secret": "s3cret", "allowDebug": true}}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"trusted caller": {
+				config:         config,
+				requestHeaders: [][2]string{{"x-problem-details", "debug"}, {"x-problem-details-secret", "s3cret"}},
+				expectDebug:    true,
+			},
+			"untrusted caller": {
+				config:         config,
+				requestHeaders: [][2]string{{"x-problem-details", "debug"}, {"x-problem-details-secret", "guess"}},
+			},
+			"no debug requested": {
+				config:         config,
+				requestHeaders: [][2]string{{"x-problem-details", "on"}, {"x-problem-details-secret", "s3cret"}},
+			},
+			"debug not allowed": {
+				config:         `{"targetURLPrefixes": ["my-host.com"], "requestOverride": {"secret": "s3cret"}}`,
+				requestHeaders: [][2]string{{"x-problem-details", "debug"}, {"x-problem-details-secret", "s3cret"}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(tCase.config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				require.NoError(t, host.SetProperty([]string{"xds", "cluster_name"}, []byte("outbound|8080||foo.default.svc.cluster.local")))
+				flags := make([]byte, 8)
+				binary.LittleEndian.PutUint64(flags, 0x2)
+				require.NoError(t, host.SetProperty([]string{"response", "flags"}, flags))
+
+				id := host.InitializeHttpContext()
+				hs := append([][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, tCase.requestHeaders...)
+				host.CallOnRequestHeaders(id, hs, false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", "503"}, {"content-type", "text/plain"}}, false)
+				host.CallOnResponseBody(id, []byte("no healthy upstream"), true)
+				host.CompleteHttpContext(id)
+
+				var problem customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &problem))
+				if !tCase.expectDebug {
+					require.Nil(t, problem.Debug)
+					return
+				}
+				require.NotNil(t, problem.Debug)
+				require.Equal(t, "default", problem.Debug.Rule)
+				require.Equal(t, "UH", problem.Debug.ResponseFlags)
+				require.Equal(t, "outbound|8080||foo.default.svc.cluster.local", problem.Debug.UpstreamCluster)
+				require.Equal(t, "text/plain", problem.Debug.OriginalContentType)
+				require.Equal(t, len("no healthy upstream"), problem.Debug.OriginalBodyBytes)
+			})
+		}
+	})
+
+	t.Run("allowDebug requires a secret", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "requestOverride": {"allowDebug": true}}`))
+		require.Error(t, err)
+	})
+}
+
+func TestConfigurationValidation(t *testing.T) {
+	t.Run("every problem is reported", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{
+			"targetURLPrefixes": ["my-host.com", 42],
+			"startStatusCode": 500,
+			"endStatusCode": 450,
+			"problemTypeURIMap": {"404": "https://example.com/not-found", "abc": "https://example.com", "500": ""},
+			"statusRemaps": [{"from": "502", "to": 700, "responseFlags": ["XX"]}],
+			"traceIDHeader": {"name": "x-trace", "colour": "red"},
+			"mode": "audit",
+			"unknownKey": true
+		}`))
+		require.Error(t, err)
+		for _, expected := range []string{
+			"$.targetURLPrefixes[1]: must be a string: 42",
+			"$.endStatusCode: the range 500-450 is empty",
+			`$.problemTypeURIMap["abc"]: "abc" is not a status code between 400 and 599`,
+			`$.problemTypeURIMap["500"]: "" is not a valid URI`,
+			`$.statusRemaps[0].from: must be an integer: "502"`,
+			"$.statusRemaps[0].to: must be between 400 and 599: 700",
+			`$.statusRemaps[0].responseFlags[0]: unknown response flag "XX"`,
+			"$.traceIDHeader.colour: unknown field",
+			`$.mode: must be "enforce" or "shadow": "audit"`,
+			"$.unknownKey: unknown field",
+		} {
+			require.Contains(t, err.Error(), expected)
+		}
+		// A value of the wrong type is only reported once
+		require.Equal(t, 1, strings.Count(err.Error(), "$.statusRemaps[0].from"))
+	})
+
+	t.Run("header names, rule names, title keys and empty prefixes", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{
+			"targetURLPrefixes": [""],
+			"rules": [
+				{"name": "api", "targetURLPrefixes": ["api.my-host.com"], "rollout": {"percentage": 10, "hashHeader": "x user"}},
+				{"name": "api", "targetURLPrefixes": ["api.my-host.com"], "requestHeaders": [{"name": "x-api version", "present": true}]},
+				{"name": "default", "targetURLPrefixes": ["my-host.com"]},
+				{"name": "none", "targetURLPrefixes": ["my-host.com"]}
+			],
+			"problemTitles": {"5O3": "Unavailable", "https://example.com/problems/busy": "Busy", "/problems/gone": "Gone"},
+			"localizedProblemTitles": {"de": {"40": "Nicht gefunden"}},
+			"statusRemaps": [{"from": 502, "to": 503, "targetURLPrefixes": [""]}],
+			"traceIDHeader": {"name": "bad header"},
+			"requestOverride": {"header": "x-override:", "secretHeader": "x secret", "secret": "s3cret"}
+		}`))
+		require.Error(t, err)
+		for _, expected := range []string{
+			"$.targetURLPrefixes[0]: must not be empty, it would match every request",
+			`$.rules[0].rollout.hashHeader: must be a header name: "x user"`,
+			`$.rules[1].name: duplicate rule name "api"`,
+			`$.rules[1].requestHeaders[0].name: must be a header name: "x-api version"`,
+			`$.rules[2].name: "default" is reserved`,
+			`$.rules[3].name: "none" is reserved`,
+			`$.problemTitles["5O3"]: "5O3" is not a status code between 400 and 599 or a problem type URI`,
+			`$.localizedProblemTitles["de"]["40"]: "40" is not a status code between 400 and 599 or a problem type URI`,
+			"$.statusRemaps[0].targetURLPrefixes[0]: must not be empty, it would match every request",
+			`$.traceIDHeader.name: must be a header name: "bad header"`,
+			`$.requestOverride.header: must be a header name: "x-override:"`,
+			`$.requestOverride.secretHeader: must be a header name: "x secret"`,
+		} {
+			require.Contains(t, err.Error(), expected)
+		}
+		require.NotContains(t, err.Error(), "example.com/problems/busy")
+		require.NotContains(t, err.Error(), "/problems/gone")
+	})
+
+	t.Run("IsHeaderName", func(t *testing.T) {
+		for _, name := range []string{"x-trace-id", "X-Request-ID", "x_custom.v2", "~!#$%&'*+^`|"} {
+			require.True(t, IsHeaderName(name), name)
+		}
+		for _, name := range []string{"", "bad header", ":status", "x-trace:", "x\u00e9", "x\ttab", "(x)"} {
+			require.False(t, IsHeaderName(name), name)
+		}
+	})
+
+	t.Run("status codes out of range", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "startStatusCode": 200, "endStatusCode": 600}`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "$.startStatusCode: must be between 400 and 599: 200")
+		require.Contains(t, err.Error(), "$.endStatusCode: must be between 400 and 599: 600")
+	})
+
+	t.Run("custom problemTypeURIMap", func(t *testing.T) {
+		config, err := parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "problemTypeURIMap": {"404": "https://example.com/not-found"}}`))
+		require.NoError(t, err)
+		require.Equal(t, "https://example.com/not-found", GetProblemTypeURI("404", config.problemTypeURIMap))
+	})
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.NewEmulatorOption().
+			WithPluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "endStatusCode": "599"}`)).
+			WithVMContext(vm)
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+		logs := host.GetCriticalLogs()
+		require.NotEmpty(t, logs)
+		require.Contains(t, logs[0], "$.endStatusCode: must be an integer")
+	})
+}
+
+func TestProblemTypeURIs(t *testing.T) {
+	type testCase struct {
+		config   string
+		expected map[string]string
+	}
+
+	for name, tCase := range map[string]testCase{
+		"merged with the defaults": {
+			config: `{"targetURLPrefixes": ["my-host.com"], "problemTypeURIMap": {"404": "https://errors.example.com/missing", "500": null, "418": "/errors/teapot"}}`,
+			expected: map[string]string{
+				"404": "https://errors.example.com/missing",
+				"503": "https://datatracker.ietf.org/html/rfc9110#section-15.6.4",
+				"500": "https://datatracker.ietf.org/doc/html/rfc9110#name-server-error-5xx",
+				"418": "/errors/teapot",
+			},
+		},
+		"base URI with the status": {
+			config: `{"targetURLPrefixes": ["my-host.com"], "problemTypeBaseURI": "https://errors.example.com/{status}", "problemTypeURIMap": {"404": "https://errors.example.com/missing", "410": null}}`,
+			expected: map[string]string{
+				"404": "https://errors.example.com/missing",
+				"599": "https://errors.example.com/599",
+				"410": "https://datatracker.ietf.org/doc/html/rfc9110#name-client-error-4xx",
+			},
+		},
+		"base URI with the slug": {
+			config: `{"targetURLPrefixes": ["my-host.com"], "problemTypeBaseURI": "/errors/{slug}"}`,
+			expected: map[string]string{
+				"429": "/errors/too-many-requests",
+				"505": "/errors/http-version-not-supported",
+				"418": "/errors/418",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := parsePluginConfiguration([]byte(tCase.config))
+			require.NoError(t, err)
+			for statusCode, expected := range tCase.expected {
+				require.Equal(t, expected, GetProblemTypeURI(statusCode, config.problemTypeURIMap), statusCode)
+			}
+			// The defaults are never modified
+			require.Equal(t, "https://datatracker.ietf.org/html/rfc9110#section-15.6.1", defaultProblemTypeURIMap["500"])
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, config := range []string{
+			`{"targetURLPrefixes": ["my-host.com"], "problemTypeBaseURI": "https://errors.example.com/"}`,
+			`{"targetURLPrefixes": ["my-host.com"], "problemTypeBaseURI": "https://errors.example.com/{code}/{status}"}`,
+			`{"targetURLPrefixes": ["my-host.com"], "problemTypeURIMap": {"404": "https://errors.example.com/not found"}}`,
+		} {
+			_, err := parsePluginConfiguration([]byte(config))
+			require.Error(t, err, config)
+		}
+	})
+
+	t.Run("IsURIReference", func(t *testing.T) {
+		for uri, expected := range map[string]bool{
+			"https://errors.example.com/404": true,
+			"/errors/404":                    true,
+			"about:blank":                    true,
+			"urn:problem:not-found":          true,
+			"https://datatracker.ietf.org/html/rfc9110#section-15.5.5": true,
+			"https://example.com/a%20b":                                true,
+			"":                                                         false,
+			"https://example.com/a b":                                  false,
+			"https://example.com/a%2":                                  false,
+			"https://example.com/#a#b":                                 false,
+			"1http://example.com":                                      false,
+			"https://example.com/<script>":                             false,
+		} {
+			require.Equal(t, expected, IsURIReference(uri), uri)
+		}
+	})
+}
+
+func TestStatusSets(t *testing.T) {
+	t.Run("ParseStatusSet", func(t *testing.T) {
+		set, err := ParseStatusSet("401, 403,429,500-504, !502")
+		require.NoError(t, err)
+		for _, statusCode := range []int{401, 403, 429, 500, 501, 503, 504} {
+			require.True(t, set.contains(statusCode), statusCode)
+		}
+		for _, statusCode := range []int{200, 400, 404, 502, 505, 599, 600} {
+			require.False(t, set.contains(statusCode), statusCode)
+		}
+
+		set, err = ParseStatusSet("5xx,4XX,!404")
+		require.NoError(t, err)
+		require.True(t, set.contains(400))
+		require.True(t, set.contains(599))
+		require.False(t, set.contains(404))
+
+		// Only exclusions are removed from 400-599
+		set, err = ParseStatusSet("!404")
+		require.NoError(t, err)
+		require.True(t, set.contains(403))
+		require.False(t, set.contains(404))
+
+		for _, expr := range []string{"", "abc", "200", "404-600", "504-500", "3xx", "4xx,!4xx"} {
+			_, err := ParseStatusSet(expr)
+			require.Error(t, err, expr)
+		}
+	})
+
+	t.Run("can't be combined with the range", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["my-host.com"], "statusCodes": "5xx", "endStatusCode": 503}`))
+		require.Error(t, err)
+	})
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		config := `{"targetURLPrefixes": ["my-host.com"], "statusCodes": "401,403,429,500-504,!502"}`
+		for statusCode, expected := range map[string]types.Action{
+			"403": types.ActionPause,
+			"503": types.ActionPause,
+			"404": types.ActionContinue,
+			"502": types.ActionContinue,
+		} {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(config)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+			action := host.CallOnResponseHeaders(id, [][2]string{{":status", statusCode}}, false)
+			require.Equal(t, expected, action, statusCode)
+			reset()
+		}
+	})
+}
+
+func TestRequestMatchers(t *testing.T) {
+	type testCase struct {
+		method         string
+		requestHeaders [][2]string
+		expectedRule   string
+		expectedAction types.Action
+	}
+
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"rules": [
+			{"name": "writes", "targetURLPrefixes": ["api.my-host.com"], "methods": ["post", "PUT"]},
+			{"name": "v2", "targetURLPrefixes": ["api.my-host.com"], "requestHeaders": [{"name": "X-Api-Version", "prefix": "2."}]},
+			{"name": "tunnels", "targetURLPrefixes": ["api.my-host.com"], "methods": ["CONNECT"], "requestHeaders": [{"name": "x-tunnel", "present": true}]},
+			{"name": "no-client", "targetURLPrefixes": ["api.my-host.com"], "requestHeaders": [{"name": "x-client", "present": false}]},
+			{"name": "clients", "targetURLPrefixes": ["api.my-host.com"], "requestHeaders": [{"name": "x-client", "regex": "^(web|ios)$"}, {"name": "x-tenant", "exact": "acme"}]}
+		]
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"method": {
+				method:         "POST",
+				requestHeaders: [][2]string{{"x-client", "web"}},
+				expectedRule:   "writes",
+				expectedAction: types.ActionPause,
+			},
+			"header prefix": {
+				method:         "GET",
+				requestHeaders: [][2]string{{"x-api-version", "2.1"}, {"x-client", "web"}},
+				expectedRule:   "v2",
+				expectedAction: types.ActionPause,
+			},
+			"header absent": {
+				method:         "GET",
+				expectedRule:   "no-client",
+				expectedAction: types.ActionPause,
+			},
+			"header regex and exact": {
+				method:         "GET",
+				requestHeaders: [][2]string{{"x-client", "ios"}, {"x-tenant", "acme"}},
+				expectedRule:   "clients",
+				expectedAction: types.ActionPause,
+			},
+			"falls through to the default rule": {
+				method:         "GET",
+				requestHeaders: [][2]string{{"x-client", "android"}, {"x-tenant", "acme"}},
+				expectedRule:   "default",
+				expectedAction: types.ActionPause,
+			},
+			"HEAD is never rewritten": {
+				method:         "HEAD",
+				expectedRule:   "no-client",
+				expectedAction: types.ActionContinue,
+			},
+			"CONNECT only when asked for": {
+				method:         "CONNECT",
+				expectedRule:   "none",
+				expectedAction: types.ActionContinue,
+			},
+			"CONNECT asked for": {
+				method:         "CONNECT",
+				requestHeaders: [][2]string{{"x-tunnel", "1"}},
+				expectedRule:   "tunnels",
+				expectedAction: types.ActionPause,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				hs := append([][2]string{{":authority", "api.my-host.com"}, {":scheme", "https"}, {":path", "/"}, {":method", tCase.method}}, tCase.requestHeaders...)
+				host.CallOnRequestHeaders(id, hs, false)
+				action := host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}, {"content-length", "5"}}, false)
+				require.Equal(t, tCase.expectedAction, action)
+
+				rule, err := host.GetProperty([]string{"problem_details.rule"})
+				require.NoError(t, err)
+				require.Equal(t, tCase.expectedRule, string(rule))
+			})
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, config := range []string{
+			`{"targetURLPrefixes": ["my-host.com"], "methods": ["HEAD"]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "requestHeaders": [{"name": "x-a"}]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "requestHeaders": [{"name": "x-a", "exact": "a", "prefix": "b"}]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "requestHeaders": [{"exact": "a"}]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "requestHeaders": [{"name": "x-a", "regex": "("}]}`,
+			`{"rules": [{"targetURLPrefixes": ["my-host.com"]}], "methods": ["GET"]}`,
+		} {
+			_, err := parsePluginConfiguration([]byte(config))
+			require.Error(t, err, config)
+		}
+	})
+}
+
+func TestResponseMatchers(t *testing.T) {
+	type testCase struct {
+		responseHeaders [][2]string
+		expectedRule    string
+		expectedAction  types.Action
+	}
+
+	config := `{
+		"rules": [
+			{"name": "overloaded", "targetURLPrefixes": ["my-host.com"], "responseHeaders": [{"name": "x-envoy-overloaded", "present": true}]},
+			{"name": "legacy", "targetURLPrefixes": ["my-host.com"], "responseHeaders": [{"name": "server", "regex": "^legacy/"}]},
+			{"name": "text", "targetURLPrefixes": ["my-host.com"], "contentTypes": ["text/plain", "TEXT/HTML"]}
+		]
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"content-type with parameters": {
+				responseHeaders: [][2]string{{":status", "503"}, {"content-type", "text/plain; charset=utf-8"}},
+				expectedRule:    "text",
+				expectedAction:  types.ActionPause,
+			},
+			"json is left alone": {
+				responseHeaders: [][2]string{{":status", "503"}, {"content-type", "application/json"}},
+				expectedRule:    "none",
+				expectedAction:  types.ActionContinue,
+			},
+			"header present": {
+				responseHeaders: [][2]string{{":status", "503"}, {"content-type", "application/json"}, {"x-envoy-overloaded", "true"}},
+				expectedRule:    "overloaded",
+				expectedAction:  types.ActionPause,
+			},
+			"header regex": {
+				responseHeaders: [][2]string{{":status", "500"}, {"server", "legacy/1.0"}},
+				expectedRule:    "legacy",
+				expectedAction:  types.ActionPause,
+			},
+			"no content-type": {
+				responseHeaders: [][2]string{{":status", "500"}},
+				expectedRule:    "none",
+				expectedAction:  types.ActionContinue,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+				action := host.CallOnResponseHeaders(id, tCase.responseHeaders, false)
+				require.Equal(t, tCase.expectedAction, action)
+
+				rule, err := host.GetProperty([]string{"problem_details.rule"})
+				require.NoError(t, err)
+				require.Equal(t, tCase.expectedRule, string(rule))
+			})
+		}
+	})
+
+	t.Run("MatchesContentType", func(t *testing.T) {
+		require.True(t, MatchesContentType("text/html; charset=utf-8", []string{"text/*"}))
+		require.True(t, MatchesContentType("Text/Plain", []string{"text/plain"}))
+		require.False(t, MatchesContentType("text/plain", []string{"text/html"}))
+		require.False(t, MatchesContentType("application/json", []string{"text/*"}))
+		require.False(t, MatchesContentType("", []string{"text/*"}))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, config := range []string{
+			`{"targetURLPrefixes": ["my-host.com"], "contentTypes": ["text"]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "contentTypes": ["*/*"]}`,
+			`{"targetURLPrefixes": ["my-host.com"], "responseHeaders": [{"name": "server"}]}`,
+			`{"rules": [{"targetURLPrefixes": ["my-host.com"]}], "contentTypes": ["text/plain"]}`,
+		} {
+			_, err := parsePluginConfiguration([]byte(config))
+			require.Error(t, err, config)
+		}
+	})
+}
+
+func TestVirtualHosts(t *testing.T) {
+	type testCase struct {
+		authority      string
+		status         string
+		expectedAction types.Action
+		expectedTitle  string
+		expectedType   string
+	}
+
+	config := `{
+		"targetURLPrefixes": ["example.com", "tenant.io"],
+		"problemTitle": "default title",
+		"statusCodes": "5xx",
+		"virtualHosts": {
+			"api.example.com": {"problemTitle": "api title", "startStatusCode": 400, "endStatusCode": 499},
+			"*.example.com": {"problemTitle": "wildcard title", "problemTypeBaseURI": "https://errors.example.com/{status}"},
+			"*.shop.example.com": {"problemTitle": "shop title"},
+			"*": {"problemTitles": {"503": "Please try again"}}
+		}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"exact host with a port": {
+				authority:      "API.example.com:8443",
+				status:         "404",
+				expectedAction: types.ActionPause,
+				expectedTitle:  "api title",
+				expectedType:   "https://datatracker.ietf.org/html/rfc9110#section-15.5.5",
+			},
+			"exact host status set": {
+				authority:      "api.example.com",
+				status:         "503",
+				expectedAction: types.ActionContinue,
+			},
+			"wildcard host": {
+				authority:      "www.example.com",
+				status:         "503",
+				expectedAction: types.ActionPause,
+				expectedTitle:  "wildcard title",
+				expectedType:   "https://errors.example.com/503",
+			},
+			"most specific wildcard": {
+				authority:      "eu.shop.example.com",
+				status:         "502",
+				expectedAction: types.ActionPause,
+				expectedTitle:  "shop title",
+				expectedType:   "https://datatracker.ietf.org/html/rfc9110#section-15.6.3",
+			},
+			"default block": {
+				authority:      "tenant.io",
+				status:         "503",
+				expectedAction: types.ActionPause,
+				expectedTitle:  "Please try again",
+				expectedType:   "https://datatracker.ietf.org/html/rfc9110#section-15.6.4",
+			},
+			"default block keeps the top level settings": {
+				authority:      "tenant.io",
+				status:         "404",
+				expectedAction: types.ActionContinue,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", tCase.authority}, {":scheme", "https"}, {":path", "/"}}, false)
+				action := host.CallOnResponseHeaders(id, [][2]string{{":status", tCase.status}}, false)
+				require.Equal(t, tCase.expectedAction, action)
+				if action != types.ActionPause {
+					return
+				}
+				host.CallOnResponseBody(id, []byte("error"), true)
+
+				var problem customErrorResponse
+				require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &problem))
+				require.Equal(t, tCase.expectedTitle, problem.Title)
+				require.Equal(t, tCase.expectedType, problem.Type)
+			})
+		}
+	})
+
+	t.Run("StripPort", func(t *testing.T) {
+		require.Equal(t, "example.com", StripPort("example.com:8080"))
+		require.Equal(t, "example.com", StripPort("example.com"))
+		require.Equal(t, "[::1]", StripPort("[::1]:8080"))
+		require.Equal(t, "[::1]", StripPort("[::1]"))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := parsePluginConfiguration([]byte(`{
+			"targetURLPrefixes": ["example.com"],
+			"virtualHosts": {
+				"a.example.com": {"statusCodes": "200"},
+				"b.*.example.com": {},
+				"c.example.com": {"problemTitle": "{{unknown}}"},
+				"d.example.com:8080": {}
+			}
+		}`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `$.virtualHosts["a.example.com"].statusCodes: "200" is outside of 400-599`)
+		require.Contains(t, err.Error(), `$.virtualHosts["b.*.example.com"]: must be a host`)
+		require.Contains(t, err.Error(), `$.virtualHosts["c.example.com"].problemTitle`)
+		require.Contains(t, err.Error(), `$.virtualHosts["d.example.com:8080"]: must not have a port`)
+
+		_, err = parsePluginConfiguration([]byte(`{"targetURLPrefixes": ["example.com"], "virtualHosts": {"a.example.com": {"targetURLPrefixes": ["b"]}}}`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `$.virtualHosts["a.example.com"].targetURLPrefixes: unknown field`)
+	})
+}
+
+func TestRouteMetadata(t *testing.T) {
+	type testCase struct {
+		authority string
+		// a JSON string in the config field
+		metadata string
+		// the fields of the problem_details struct as serialized by Envoy
+		fields         map[string][]byte
+		expectedAction types.Action
+		expectedRule   string
+		expectedTitle  string
+		expectedDetail string
+	}
+
+	envoyBool := func(value bool) []byte {
+		if value {
+			return []byte{1}
+		}
+		return []byte{0}
+	}
+	envoyNumber := func(value float64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, math.Float64bits(value))
+		return b
+	}
+
+	config := `{
+		"targetURLPrefixes": ["my-host.com"],
+		"problemTitle": "default title",
+		"routeMetadata": {},
+		"virtualHosts": {"vhost.my-host.com": {"problemTitle": "vhost title", "detailTemplate": "{{status}}"}}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for name, tCase := range map[string]testCase{
+			"no metadata": {
+				authority:      "my-host.com",
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "default title",
+			},
+			"override": {
+				authority:      "my-host.com",
+				metadata:       `{"problemTitle": "route title"}`,
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "route title",
+			},
+			"overlaid on the virtual host": {
+				authority:      "vhost.my-host.com",
+				metadata:       `{"problemTitle": "route title"}`,
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "route title",
+				expectedDetail: "500",
+			},
+			"disabled": {
+				authority:      "my-host.com",
+				metadata:       `{"enabled": false}`,
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"enabled": {
+				authority:      "other-host.com",
+				metadata:       `{"enabled": true, "problemTitle": "route title"}`,
+				expectedAction: types.ActionPause,
+				expectedRule:   "route",
+				expectedTitle:  "route title",
+			},
+			"invalid settings are ignored": {
+				authority:      "my-host.com",
+				metadata:       `{"problemTitle": 1}`,
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "default title",
+			},
+			"enabled is honoured with invalid settings": {
+				authority:      "my-host.com",
+				metadata:       `{"problemTitle": 1, "enabled": false}`,
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"struct disabled": {
+				authority:      "my-host.com",
+				fields:         map[string][]byte{"enabled": envoyBool(false)},
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"struct settings": {
+				authority: "other-host.com",
+				fields: map[string][]byte{
+					"enabled":         envoyBool(true),
+					"problemTitle":    []byte("struct title"),
+					"startStatusCode": envoyNumber(500),
+					"problemTitles":   []byte(`{"500": "struct 500 title"}`),
+				},
+				expectedAction: types.ActionPause,
+				expectedRule:   "route",
+				expectedTitle:  "struct 500 title",
+			},
+			"struct fields override the config string": {
+				authority:      "my-host.com",
+				metadata:       `{"problemTitle": "route title", "enabled": false}`,
+				fields:         map[string][]byte{"enabled": envoyBool(true)},
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "route title",
+			},
+			"struct field with the wrong type": {
+				authority:      "my-host.com",
+				fields:         map[string][]byte{"enabled": envoyBool(false), "startStatusCode": []byte("500")},
+				expectedAction: types.ActionContinue,
+				expectedRule:   "default",
+			},
+			"unknown settings are ignored": {
+				authority:      "my-host.com",
+				metadata:       `{"targetURLPrefixes": ["other-host.com"]}`,
+				expectedAction: types.ActionPause,
+				expectedRule:   "default",
+				expectedTitle:  "default title",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opt := proxytest.NewEmulatorOption().
+					WithPluginConfiguration([]byte(config)).
+					WithVMContext(vm)
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				if tCase.metadata != "" {
+					require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "problem_details", "config"}, []byte(tCase.metadata)))
+				}
+				for field, value := range tCase.fields {
+					require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "problem_details", field}, value))
+				}
+				// The second request uses the cached route settings
+				for i := 0; i < 2; i++ {
+					id := host.InitializeHttpContext()
+					host.CallOnRequestHeaders(id, [][2]string{{":authority", tCase.authority}, {":scheme", "https"}, {":path", "/"}}, false)
+					action := host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}}, false)
+					require.Equal(t, tCase.expectedAction, action)
+
+					rule, err := host.GetProperty([]string{"problem_details.rule"})
+					require.NoError(t, err)
+					require.Equal(t, tCase.expectedRule, string(rule))
+					if action != types.ActionPause {
+						continue
+					}
+					host.CallOnResponseBody(id, []byte("error"), true)
+
+					var problem customErrorResponse
+					require.NoError(t, json.Unmarshal(host.GetCurrentResponseBody(id), &problem))
+					require.Equal(t, tCase.expectedTitle, problem.Title)
+					if tCase.expectedDetail != "" {
+						require.Equal(t, tCase.expectedDetail, problem.Detail)
+					}
+				}
+			})
+		}
+
+		t.Run("only read for error responses", func(t *testing.T) {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(config)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "problem_details", "startStatusCode"}, []byte("500")))
+			call := func(status string) {
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"}}, false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", status}}, false)
+				host.CompleteHttpContext(id)
+			}
+			call("200")
+			require.Empty(t, host.GetWarnLogs())
+			call("503")
+			requireLogRecord(t, host.GetWarnLogs(), logRecord{Event: "route_config_invalid", Message: "ignoring the startStatusCode route metadata"})
+		})
+
+		t.Run("request headers are kept for the route settings", func(t *testing.T) {
+			opt := proxytest.NewEmulatorOption().
+				WithPluginConfiguration([]byte(config)).
+				WithVMContext(vm)
+			host, reset := proxytest.NewHostEmulator(opt)
+			defer reset()
+
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+			require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "problem_details", "config"},
+				[]byte(`{"htmlErrorPages": true, "localizedProblemTitles": {"de": {"500": "Interner Fehler"}}}`)))
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":authority", "my-host.com"}, {":scheme", "https"}, {":path", "/"},
+				{"accept", "text/html"}, {"accept-language", "de-DE"},
+			}, false)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "500"}}, false)
+			host.CallOnResponseBody(id, []byte("error"), true)
+			host.CompleteHttpContext(id)
+
+			require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"content-type", "text/html; charset=utf-8"})
+			require.Contains(t, string(host.GetCurrentResponseBody(id)), "Interner Fehler")
+		})
 	})
 }
 